@@ -0,0 +1,59 @@
+package diff
+
+import (
+	"math"
+	"math/bits"
+)
+
+const (
+	// DefaultBlockSize is recommended if the basis length is not known up front.
+	DefaultBlockSize = uint32(2048)
+
+	// minBlockSize and maxBlockSize bound the recommended block size:
+	// smaller blocks bloat signatures of small files, larger ones rarely match in large files.
+	minBlockSize = uint32(256)
+	maxBlockSize = uint32(128 * 1024)
+	// blockSizeAlign is the granularity of recommended block sizes.
+	blockSizeAlign = uint32(128)
+)
+
+// RecommendBlockSize recommends the block size and the strong checksum size of a signature for a basis of basisLength bytes.
+//
+// Like rsync, the block size grows with the square root of the basis length (aligned to 128 bytes, in [256, 128KB]),
+// which balances the signature size against the chance of matching blocks.
+// Like librsync, the strong checksum is long enough to keep the probability of a false match (a block matching
+// the weak and strong checksums of a different block) anywhere in a file of up to basisLength+16MB bytes below 2^-16.
+// The strong size never exceeds the digest length of strongHash.
+//
+// If basisLength is UnknownLength, DefaultBlockSize and the whole digest are recommended.
+func RecommendBlockSize(basisLength uint64, strongHash StrongHash) (blockSize uint32, strongSize byte) {
+	if basisLength == UnknownLength {
+		return DefaultBlockSize, byte(strongHash.Size())
+	}
+
+	blockSize = uint32(math.Ceil(math.Sqrt(float64(basisLength))))
+	blockSize = (blockSize + blockSizeAlign - 1) / blockSizeAlign * blockSizeAlign
+	if blockSize < minBlockSize {
+		blockSize = minBlockSize
+	}
+	if blockSize > maxBlockSize {
+		blockSize = maxBlockSize
+	}
+	return blockSize, recommendStrongSize(basisLength, blockSize, strongHash)
+}
+
+// recommendStrongSize returns the strong checksum size for a basis of basisLength bytes split into blocks of blockSize bytes.
+// A new file position is compared with every block, so the number of strong checksum bits needed is roughly
+// log2(new file length) + log2(blocks), plus 16 bits of safety margin (see librsync's rs_sig_args).
+func recommendStrongSize(basisLength uint64, blockSize uint32, strongHash StrongHash) byte {
+	if basisLength == UnknownLength {
+		return byte(strongHash.Size())
+	}
+
+	n := bits.Len64(basisLength+1<<24) + bits.Len64(basisLength/uint64(blockSize)+1)
+	strongSize := 2 + (n+7)/8
+	if strongSize > strongHash.Size() {
+		strongSize = strongHash.Size()
+	}
+	return byte(strongSize)
+}
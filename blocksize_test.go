@@ -0,0 +1,66 @@
+package diff
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecommendBlockSize(t *testing.T) {
+	require := require.New(t)
+
+	for _, tc := range []struct {
+		basisLength uint64
+		strongHash  StrongHash
+		blockSize   uint32
+		strongSize  byte
+	}{
+		{0, MD5, 256, 6},
+		{50, MD5, 256, 6},
+		{64 * 1024, MD5, 256, 7},
+		{1 << 20, MD5, 1024, 7},
+		{10 << 30, SHA256, 103680, 9},
+		{1 << 40, BLAKE2b, 128 * 1024, 11},
+		{1 << 40, StrongHash(0xff), 128 * 1024, 0},
+		{UnknownLength, MD5, DefaultBlockSize, 16},
+		{UnknownLength, SHA256, DefaultBlockSize, 32},
+	} {
+		blockSize, strongSize := RecommendBlockSize(tc.basisLength, tc.strongHash)
+		require.Equalf(tc.blockSize, blockSize, "basis length: %d", tc.basisLength)
+		require.Equalf(tc.strongSize, strongSize, "basis length: %d", tc.basisLength)
+		require.Zero(blockSize % blockSizeAlign)
+	}
+
+	// the strong size is capped at the digest length
+	for _, h := range []StrongHash{MD5, SHA1, SHA256, BLAKE2b, MD4} {
+		_, strongSize := RecommendBlockSize(1<<62, h)
+		require.LessOrEqual(int(strongSize), h.Size())
+	}
+}
+
+func TestSignatureRecommendedSizes(t *testing.T) {
+	require := require.New(t)
+
+	text := strings.Repeat(`ala ma kota,kot ma ale,`, 10000)
+	blockSize, strongSize := RecommendBlockSize(uint64(len(text)), SHA256)
+
+	sig, err := SignatureOptions{StrongHash: SHA256}.WriteSignature(strings.NewReader(text), bytes.NewBuffer(nil))
+	require.NoError(err)
+	require.Equal(blockSize, sig.BlockSize)
+	require.Equal(strongSize, sig.StrongSize)
+
+	// a given block size is kept, only the strong size is recommended
+	sig, err = WriteSignature(strings.NewReader(text), bytes.NewBuffer(nil), 64, 0)
+	require.NoError(err)
+	require.Equal(uint32(64), sig.BlockSize)
+	require.Equal(recommendStrongSize(uint64(len(text)), 64, MD5), sig.StrongSize)
+
+	// the length of a stream is not known up front
+	sig, err = SignatureOptions{}.WriteSignature(struct{ io.Reader }{strings.NewReader(text)}, bytes.NewBuffer(nil))
+	require.NoError(err)
+	require.Equal(DefaultBlockSize, sig.BlockSize)
+	require.Equal(byte(MD5.Size()), sig.StrongSize)
+}
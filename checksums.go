@@ -0,0 +1,106 @@
+package diff
+
+import (
+	"fmt"
+	"io"
+	"slices"
+)
+
+// maxBlocks is the number of blocks a signature can hold, as block numbers are stored in 32 bits.
+const maxBlocks = uint64(1<<32 - 1)
+
+type (
+	// signatureChecksum holds the checksums of all blocks in two flat slices: the weak index, and an arena of strong checksums.
+	// It takes 8+StrongSize bytes per block, and has no pointers per block for the garbage collector to scan.
+	signatureChecksum struct {
+		// index holds the weak checksum of every block, see weakIndex.
+		index weakIndex
+		// strong holds the strong checksums of all blocks in basis order, strongSize bytes each,
+		// unless they are read from strongReader (see OpenSignature).
+		strong     []byte
+		strongSize int
+		// strongReader holds the signature records, from strongOffset on.
+		strongReader io.ReaderAt
+		strongOffset int64
+	}
+
+	// weakIndex holds weak<<32 | n for every block n, sorted: blocks sharing a weak checksum are adjacent,
+	// in basis order, and are found by binary search.
+	weakIndex []uint64
+)
+
+// newSignatureChecksum returns empty checksums with room for blocks blocks (which is not trusted, headers may be corrupt).
+func newSignatureChecksum(strongSize byte, blocks uint64) signatureChecksum {
+	blocks = min(blocks, 1<<20)
+	return signatureChecksum{
+		index:      make(weakIndex, 0, blocks),
+		strong:     make([]byte, 0, blocks*uint64(strongSize)),
+		strongSize: int(strongSize),
+	}
+}
+
+// add appends the checksums of the next block. strong is not kept if the strong checksums are read from strongReader.
+// The index has to be sorted once all blocks were added.
+func (c *signatureChecksum) add(weak uint32, strong []byte) error {
+	n := uint64(len(c.index))
+	if n == maxBlocks {
+		return fmt.Errorf("more than %d blocks", maxBlocks)
+	}
+	c.index = append(c.index, uint64(weak)<<32|n)
+	if c.strongReader == nil {
+		c.strong = append(c.strong, strong[:c.strongSize]...)
+	}
+	return nil
+}
+
+// sort sorts the index, blocks are added in basis order so the index is in block order until then.
+func (c *signatureChecksum) sort() {
+	slices.Sort(c.index)
+}
+
+// count returns the number of blocks.
+func (c *signatureChecksum) count() int {
+	return len(c.index)
+}
+
+// strongChecksum returns the strong checksum of the n-th block.
+// Checksums backed by a reader are read into b (if it is large enough), the others must not be modified.
+func (c *signatureChecksum) strongChecksum(n int, b []byte) ([]byte, error) {
+	if c.strongReader == nil {
+		end := (n + 1) * c.strongSize
+		return c.strong[end-c.strongSize : end : end], nil
+	}
+
+	if cap(b) < c.strongSize {
+		b = make([]byte, c.strongSize)
+	}
+	b = b[:c.strongSize]
+	offset := c.strongOffset + int64(n)*int64(4+c.strongSize) + 4
+	if k, err := c.strongReader.ReadAt(b, offset); k < len(b) {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, invalidSignature(err)
+	}
+	return b, nil
+}
+
+// lookup returns the entries of all blocks with the weak checksum, in basis order.
+func (x weakIndex) lookup(weak uint32) weakIndex {
+	i, _ := slices.BinarySearch(x, uint64(weak)<<32)
+	j := i
+	for j < len(x) && x.weak(j) == weak {
+		j++
+	}
+	return x[i:j]
+}
+
+// block returns the block number of the i-th entry.
+func (x weakIndex) block(i int) int {
+	return int(uint32(x[i]))
+}
+
+// weak returns the weak checksum of the i-th entry.
+func (x weakIndex) weak(i int) uint32 {
+	return uint32(x[i] >> 32)
+}
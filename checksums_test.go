@@ -0,0 +1,110 @@
+package diff
+
+import (
+	"bytes"
+	"math/rand"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWeakIndex(t *testing.T) {
+	require := require.New(t)
+
+	rnd := rand.New(rand.NewSource(1))
+	blocks := make(map[uint32][]int)
+	checksum := newSignatureChecksum(1, 0)
+	for n := 0; n < 10000; n++ {
+		// plenty of collisions
+		weak := uint32(rnd.Intn(1000)) * 0x10001
+		blocks[weak] = append(blocks[weak], n)
+		require.NoError(checksum.add(weak, []byte{byte(n)}))
+	}
+	checksum.sort()
+
+	for weak, expected := range blocks {
+		idx := checksum.index.lookup(weak)
+		require.Len(idx, len(expected))
+		for i, n := range expected {
+			require.Equal(weak, idx.weak(i))
+			require.Equal(n, idx.block(i))
+			strong, err := checksum.strongChecksum(n, nil)
+			require.NoError(err)
+			require.Equal([]byte{byte(n)}, strong)
+		}
+		require.Empty(checksum.index.lookup(weak + 1))
+	}
+	require.Empty(checksum.index.lookup(0xffffffff))
+}
+
+// mapChecksum is how signatures used to hold their checksums, kept to compare memory usage.
+type mapChecksum struct {
+	weak   map[uint32][]int
+	strong [][]byte
+}
+
+func readMapChecksum(b []byte, strongSize int) *mapChecksum {
+	checksum := &mapChecksum{weak: make(map[uint32][]int)}
+	for i := 0; len(b) > 0; i++ {
+		v := byteOrder.Uint32(b)
+		checksum.weak[v] = append(checksum.weak[v], i)
+		checksum.strong = append(checksum.strong, append([]byte{}, b[4:4+strongSize]...))
+		b = b[4+strongSize:]
+	}
+	return checksum
+}
+
+// BenchmarkSignatureMemory reports the heap held by a signature of a million blocks, per block.
+func BenchmarkSignatureMemory(b *testing.B) {
+	const (
+		blocks     = 1 << 20
+		blockSize  = 2048
+		strongSize = 16
+	)
+
+	buf := bytes.NewBuffer(nil)
+	header := signatureHeader{
+		Version:     signatureVersion,
+		WeakHash:    Rollsum,
+		StrongHash:  MD5,
+		BlockSize:   blockSize,
+		StrongSize:  strongSize,
+		BasisLength: blocks * blockSize,
+	}
+	if err := writeSignatureHeader(buf, header); err != nil {
+		b.Fatal(err)
+	}
+	headerSize := buf.Len()
+	records := make([]byte, blocks*(4+strongSize))
+	rand.New(rand.NewSource(1)).Read(records)
+	buf.Write(records)
+	data := buf.Bytes()
+
+	for _, bm := range []struct {
+		name string
+		read func() (any, error)
+	}{
+		{"map", func() (any, error) { return readMapChecksum(data[headerSize:], strongSize), nil }},
+		{"compact", func() (any, error) { return ReadSignature(bytes.NewReader(data)) }},
+		{"readerat", func() (any, error) { return OpenSignature(bytes.NewReader(data)) }},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			var before, after runtime.MemStats
+			heap := uint64(0)
+			for n := 0; n < b.N; n++ {
+				runtime.GC()
+				runtime.ReadMemStats(&before)
+				sig, err := bm.read()
+				if err != nil {
+					b.Fatal(err)
+				}
+				runtime.GC()
+				runtime.ReadMemStats(&after)
+				heap += after.HeapAlloc - before.HeapAlloc
+				runtime.KeepAlive(sig)
+			}
+			b.ReportMetric(float64(heap)/float64(b.N)/blocks, "B/block")
+		})
+	}
+}
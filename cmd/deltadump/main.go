@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/kuba--/diff"
+)
+
+var (
+	jsonOutput bool
+	summary    bool
+)
+
+type (
+	// instruction is a JSON line per instruction.
+	instruction struct {
+		Type string `json:"type"`
+		// Offset is the offset of the instruction in the delta, NewOffset in the new file.
+		Offset      int64   `json:"offset"`
+		NewOffset   uint64  `json:"new_offset"`
+		BasisOffset *uint64 `json:"basis_offset,omitempty"`
+		Size        uint64  `json:"size"`
+	}
+
+	// stats is the JSON line of the header and the summary, last.
+	stats struct {
+		Type             string  `json:"type"`
+		Format           string  `json:"format"`
+		Version          byte    `json:"version"`
+		Encoding         string  `json:"encoding"`
+		Compression      string  `json:"compression"`
+		BlockSize        uint32  `json:"block_size"`
+		StrongHash       string  `json:"strong_hash"`
+		BasisDigest      string  `json:"basis_digest,omitempty"`
+		Size             int64   `json:"size"`
+		Length           uint64  `json:"length"`
+		Copies           int     `json:"copies"`
+		Literals         int     `json:"literals"`
+		CopyBytes        uint64  `json:"copy_bytes"`
+		LiteralBytes     uint64  `json:"literal_bytes"`
+		CompressionRatio float64 `json:"compression_ratio"`
+		LargestLiterals  []span  `json:"largest_literals"`
+		Coverage         []span  `json:"coverage"`
+		BasisBytes       uint64  `json:"basis_bytes"`
+	}
+
+	span struct {
+		Offset uint64 `json:"offset"`
+		Size   uint64 `json:"size"`
+	}
+)
+
+func main() {
+	flag.BoolVar(&jsonOutput, "json", false, "print JSON lines: one per instruction, and the summary last")
+	flag.BoolVar(&summary, "summary", false, "print the summary only, without instructions")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "%s [-json] [-summary] delta-file|-\n", flag.CommandLine.Name())
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	args := flag.Args()
+	if len(args) != 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	deltaFile := os.Stdin
+	if args[0] != "-" {
+		var err error
+		if deltaFile, err = os.Open(args[0]); err != nil {
+			fail(err)
+		}
+		defer deltaFile.Close()
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	enc := json.NewEncoder(out)
+
+	newOffset := uint64(0)
+	dump := func(offset int64, i diff.DeltaInstructionHeader) error {
+		defer func() { newOffset += i.Size }()
+		if summary {
+			return nil
+		}
+
+		if jsonOutput {
+			line := instruction{Type: "literal", Offset: offset, NewOffset: newOffset, Size: i.Size}
+			if i.From == diff.FromOld {
+				line.Type, line.BasisOffset = "copy", &i.Offset
+			}
+			return enc.Encode(line)
+		}
+		if i.From == diff.FromOld {
+			_, err := fmt.Fprintf(out, "%d\tcopy\t%d\t%d\t%d\n", offset, newOffset, i.Offset, i.Size)
+			return err
+		}
+		_, err := fmt.Fprintf(out, "%d\tliteral\t%d\t-\t%d\n", offset, newOffset, i.Size)
+		return err
+	}
+	if !summary && !jsonOutput {
+		fmt.Fprintln(out, "offset\ttype\tnew offset\tbasis offset\tsize")
+	}
+
+	s, err := diff.ReadDeltaStats(bufio.NewReader(deltaFile), dump)
+	if err != nil {
+		out.Flush()
+		fail(err)
+	}
+
+	if jsonOutput {
+		line := stats{
+			Type:             "summary",
+			Format:           s.Header.Format.String(),
+			Version:          s.Header.Version,
+			Encoding:         s.Header.Encoding.String(),
+			Compression:      s.Header.Compression.String(),
+			BlockSize:        s.Header.BlockSize,
+			StrongHash:       s.Header.StrongHash.String(),
+			BasisDigest:      fmt.Sprintf("%x", s.Header.BasisDigest),
+			Size:             s.Size,
+			Length:           s.Length,
+			Copies:           s.Copies,
+			Literals:         s.Literals,
+			CopyBytes:        s.CopyBytes,
+			LiteralBytes:     s.LiteralBytes,
+			CompressionRatio: s.CompressionRatio(),
+			LargestLiterals:  spans(s.LargestLiterals),
+			Coverage:         spans(s.Coverage),
+			BasisBytes:       s.BasisBytes,
+		}
+		if err = enc.Encode(line); err != nil {
+			fail(err)
+		}
+		return
+	}
+
+	if !summary {
+		fmt.Fprintln(out)
+	}
+	h := s.Header
+	if h.Format == diff.Native {
+		fmt.Fprintf(out, "format:            %v (version %d)\n", h.Format, h.Version)
+		fmt.Fprintf(out, "encoding:          %v\n", h.Encoding)
+		fmt.Fprintf(out, "compression:       %v\n", h.Compression)
+	} else {
+		fmt.Fprintf(out, "format:            %v\n", h.Format)
+	}
+	if h.Version > 0 {
+		fmt.Fprintf(out, "block size:        %d\n", h.BlockSize)
+		fmt.Fprintf(out, "strong hash:       %v\n", h.StrongHash)
+	}
+	if len(h.BasisDigest) > 0 {
+		fmt.Fprintf(out, "basis digest:      %x\n", h.BasisDigest)
+	}
+	fmt.Fprintf(out, "delta size:        %d\n", s.Size)
+	fmt.Fprintf(out, "new file length:   %d\n", s.Length)
+	fmt.Fprintf(out, "compression ratio: %.2f\n", s.CompressionRatio())
+	fmt.Fprintf(out, "copies:            %d (%d bytes, %s)\n", s.Copies, s.CopyBytes, percent(s.CopyBytes, s.Length))
+	fmt.Fprintf(out, "literals:          %d (%d bytes, %s)\n", s.Literals, s.LiteralBytes, percent(s.LiteralBytes, s.Length))
+	fmt.Fprintf(out, "basis copied:      %d bytes in %d ranges\n", s.BasisBytes, len(s.Coverage))
+	if len(s.LargestLiterals) > 0 {
+		fmt.Fprintln(out, "largest literals:  new offset\tsize")
+		for _, r := range s.LargestLiterals {
+			fmt.Fprintf(out, "                   %d\t%d\n", r.Offset, r.Size)
+		}
+	}
+}
+
+func spans(ranges []diff.DeltaRange) []span {
+	s := make([]span, len(ranges))
+	for n, r := range ranges {
+		s[n] = span{Offset: r.Offset, Size: r.Size}
+	}
+	return s
+}
+
+func percent(n, total uint64) string {
+	if total == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f%%", 100*float64(n)/float64(total))
+}
+
+// fail prints err on stderr, and exits.
+func fail(err error) {
+	fmt.Fprintf(os.Stderr, "%s: %v\n", flag.CommandLine.Name(), err)
+	os.Exit(2)
+}
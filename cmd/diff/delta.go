@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"time"
+
+	"github.com/kuba--/diff"
+)
+
+func deltaCommand(args []string) {
+	var (
+		deltaFlags deltaFlags
+		workers    int
+		lowMem     bool
+	)
+	fs := newFlagSet("delta", "[-rdiff | [-compact] [-compress]] [-inorder] [-workers n] [-lowmem] [-v] sig-file|- new-file|- delta-file|-")
+	deltaFlags.register(fs)
+	fs.IntVar(&workers, "workers", 0, "number of goroutines scanning segments of the new file, GOMAXPROCS by default")
+	fs.BoolVar(&lowMem, "lowmem", false, "read strong checksums from the signature file as needed, instead of loading them")
+	parse(fs, args, func() bool { return fs.NArg() == 3 })
+	if err := oneStdin(fs.Arg(0), fs.Arg(1)); err != nil {
+		usageError(fs, err)
+	}
+	if lowMem && fs.Arg(0) == stdio {
+		usageError(fs, errors.New("-lowmem needs a signature file"))
+	}
+
+	start := time.Now()
+	sigInput, err := openInput(fs.Arg(0))
+	if err != nil {
+		fail(err)
+	}
+	defer sigInput.Close()
+
+	newInput, err := openInput(fs.Arg(1))
+	if err != nil {
+		fail(err)
+	}
+	defer newInput.Close()
+
+	deltaOutput, err := createOutput(fs.Arg(2))
+	if err != nil {
+		fail(err)
+	}
+	defer deltaOutput.Close()
+
+	var sig *diff.Signature
+	if lowMem {
+		sig, err = diff.OpenSignature(sigInput)
+	} else {
+		sig, err = diff.ReadSignature(bufio.NewReader(sigInput))
+	}
+	if err != nil {
+		fail(err)
+	}
+
+	opts := deltaFlags.options()
+	opts.Workers = workers
+	stop := progress("new file", newInput)
+	w := bufio.NewWriter(deltaOutput)
+	err = writeDelta(opts, sig, newInput, w)
+	if err == nil {
+		err = w.Flush()
+	}
+	stop()
+	if err != nil {
+		fail(err)
+	}
+	summary(start, "%d signature bytes and %d new bytes read, %d delta bytes written", sigInput.n.Load(), newInput.n.Load(), deltaOutput.n.Load())
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bufio"
+	"runtime"
+	"time"
+)
+
+func diffCommand(args []string) {
+	var (
+		sigFlags   signatureFlags
+		deltaFlags deltaFlags
+		workers    int
+	)
+	fs := newFlagSet("diff", "[-b block size] [-s strong size] [-weak rollsum|rabinkarp] [-hash md5|sha1|sha256|blake2b|md4] [-rdiff | [-compact] [-compress]] [-inorder] [-workers n] [-v] basis-file|- new-file|- delta-file|-")
+	sigFlags.register(fs)
+	deltaFlags.register(fs)
+	fs.IntVar(&workers, "workers", 0, "number of goroutines checksumming blocks and scanning segments of the new file, GOMAXPROCS by default")
+	parse(fs, args, func() bool { return fs.NArg() == 3 })
+	if err := oneStdin(fs.Arg(0), fs.Arg(1)); err != nil {
+		usageError(fs, err)
+	}
+
+	// the signature is never written out, so it is a native one even for rdiff deltas
+	sigOpts, err := sigFlags.options(false)
+	if err != nil {
+		usageError(fs, err)
+	}
+	// the basis is read as a stream, checksummed in batches by the workers
+	sigOpts.Workers = workers
+	if workers <= 0 {
+		sigOpts.Workers = runtime.GOMAXPROCS(0)
+	}
+	deltaOpts := deltaFlags.options()
+	deltaOpts.Workers = workers
+
+	start := time.Now()
+	basisInput, err := openInput(fs.Arg(0))
+	if err != nil {
+		fail(err)
+	}
+	defer basisInput.Close()
+
+	newInput, err := openInput(fs.Arg(1))
+	if err != nil {
+		fail(err)
+	}
+	defer newInput.Close()
+
+	deltaOutput, err := createOutput(fs.Arg(2))
+	if err != nil {
+		fail(err)
+	}
+	defer deltaOutput.Close()
+
+	stop := progress("basis", basisInput)
+	sig, err := sigOpts.NewSignature(basisInput.reader())
+	stop()
+	if err != nil {
+		fail(err)
+	}
+
+	stop = progress("new file", newInput)
+	w := bufio.NewWriter(deltaOutput)
+	err = writeDelta(deltaOpts, sig, newInput, w)
+	if err == nil {
+		err = w.Flush()
+	}
+	stop()
+	if err != nil {
+		fail(err)
+	}
+	summary(start, "%d basis bytes (%d blocks of %d bytes) and %d new bytes read, %d delta bytes written",
+		basisInput.n.Load(), sig.BlockCount(), sig.BlockSize, newInput.n.Load(), deltaOutput.n.Load())
+}
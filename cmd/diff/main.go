@@ -0,0 +1,353 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/kuba--/diff"
+)
+
+// Exit codes of all commands.
+const (
+	exitUsage = 1
+	exitError = 2
+	// exitMismatch is returned if a file does not match its digest (or cannot be verified).
+	exitMismatch = 3
+)
+
+// stdio is the file name of stdin (for inputs) and stdout (for outputs).
+const stdio = "-"
+
+// commands are the subcommands, by name.
+var commands = map[string]func(args []string){
+	"signature": signatureCommand,
+	"delta":     deltaCommand,
+	"patch":     patchCommand,
+	"diff":      diffCommand,
+}
+
+// command is the name of the running subcommand, verbose is set by -v.
+var (
+	command string
+	verbose bool
+)
+
+func usage() {
+	name := os.Args[0]
+	fmt.Fprintf(os.Stderr, "%s signature [options] basis-file sig-file\n", name)
+	fmt.Fprintf(os.Stderr, "%s delta [options] sig-file new-file delta-file\n", name)
+	fmt.Fprintf(os.Stderr, "%s patch [options] basis-file delta-file recreated-file\n", name)
+	fmt.Fprintf(os.Stderr, "%s diff [options] basis-file new-file delta-file\n", name)
+	fmt.Fprintf(os.Stderr, "\nfiles can be - for stdin or stdout, run %s <command> -h for the options of a command\n", name)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(exitUsage)
+	}
+	run, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+		os.Exit(exitUsage)
+	}
+	command = os.Args[1]
+	run(os.Args[2:])
+}
+
+// newFlagSet returns the flag set of a command, with the -v flag.
+func newFlagSet(name, usage string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "%s %s %s\n", os.Args[0], name, usage)
+		fs.PrintDefaults()
+	}
+	fs.BoolVar(&verbose, "v", false, "report progress and a summary on stderr")
+	return fs
+}
+
+// parse parses the flags, and exits unless valid returns true.
+func parse(fs *flag.FlagSet, args []string, valid func() bool) {
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			os.Exit(0)
+		}
+		os.Exit(exitUsage)
+	}
+	if !valid() {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+}
+
+// fail prints err on stderr, and exits with exitMismatch for checksum mismatches, or exitError.
+func fail(err error) {
+	if errors.Is(err, diff.ErrChecksumMismatch) {
+		exit(exitMismatch, err)
+	}
+	exit(exitError, err)
+}
+
+// exit prints err on stderr, and exits with code.
+func exit(code int, err error) {
+	fmt.Fprintf(os.Stderr, "%s %s: %v\n", os.Args[0], command, err)
+	os.Exit(code)
+}
+
+// usageError prints err with the usage of the command, and exits.
+func usageError(fs *flag.FlagSet, err error) {
+	fmt.Fprintf(os.Stderr, "%s %s: %v\n", os.Args[0], command, err)
+	fs.Usage()
+	os.Exit(exitUsage)
+}
+
+// oneStdin returns an error if more than one of the input files is stdin.
+func oneStdin(names ...string) error {
+	n := 0
+	for _, name := range names {
+		if name == stdio {
+			n++
+		}
+	}
+	if n > 1 {
+		return errors.New("only one input can be read from stdin")
+	}
+	return nil
+}
+
+type (
+	// input is an input file (or stdin), which counts the bytes read from it for -v.
+	input struct {
+		file *os.File
+		// size is the size of a regular file, or -1.
+		size int64
+		n    atomic.Int64
+	}
+
+	// regularInput is an input which is a regular file: it can seek, and knows its length (see diff.RecommendBlockSize).
+	regularInput struct {
+		*input
+	}
+
+	// output is an output file (or stdout), which counts the bytes written to it for -v.
+	output struct {
+		file *os.File
+		n    atomic.Int64
+	}
+)
+
+// openInput opens the named file for reading, - is stdin.
+func openInput(name string) (*input, error) {
+	file := os.Stdin
+	if name != stdio {
+		var err error
+		if file, err = os.Open(name); err != nil {
+			return nil, err
+		}
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	in := &input{file: file, size: -1}
+	if info.Mode().IsRegular() {
+		in.size = info.Size()
+	}
+	return in, nil
+}
+
+func (in *input) Read(p []byte) (int, error) {
+	n, err := in.file.Read(p)
+	in.n.Add(int64(n))
+	return n, err
+}
+
+func (in *input) ReadAt(p []byte, off int64) (int, error) {
+	n, err := in.file.ReadAt(p, off)
+	in.n.Add(int64(n))
+	return n, err
+}
+
+func (in *input) Close() error {
+	return in.file.Close()
+}
+
+// reader returns the input to be read sequentially: regular files can seek, and know their length.
+func (in *input) reader() io.Reader {
+	if in.size >= 0 {
+		return regularInput{in}
+	}
+	return in
+}
+
+func (in regularInput) Seek(offset int64, whence int) (int64, error) {
+	return in.file.Seek(offset, whence)
+}
+
+// Len returns the number of bytes from the current offset to the end of the file.
+func (in regularInput) Len() int {
+	pos, err := in.file.Seek(0, io.SeekCurrent)
+	if err != nil || pos > in.size {
+		return 0
+	}
+	return int(min(in.size-pos, math.MaxInt))
+}
+
+// createOutput creates the named file, - is stdout.
+func createOutput(name string) (*output, error) {
+	if name == stdio {
+		return &output{file: os.Stdout}, nil
+	}
+	file, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return &output{file: file}, nil
+}
+
+func (out *output) Write(p []byte) (int, error) {
+	n, err := out.file.Write(p)
+	out.n.Add(int64(n))
+	return n, err
+}
+
+func (out *output) Close() error {
+	return out.file.Close()
+}
+
+// progress reports the bytes read from the named input on stderr every second with -v, until the returned function is called.
+func progress(name string, in *input) (stop func()) {
+	if !verbose {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if in.size > 0 {
+					fmt.Fprintf(os.Stderr, "%s: %s: %d of %d bytes read (%.0f%%)\n", command, name, in.n.Load(), in.size, 100*float64(min(in.n.Load(), in.size))/float64(in.size))
+				} else {
+					fmt.Fprintf(os.Stderr, "%s: %s: %d bytes read\n", command, name, in.n.Load())
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// summary prints the summary of the command on stderr, with -v.
+func summary(start time.Time, format string, args ...any) {
+	if verbose {
+		fmt.Fprintf(os.Stderr, "%s: %s in %v\n", command, fmt.Sprintf(format, args...), time.Since(start).Round(time.Millisecond))
+	}
+}
+
+// signatureFlags are the flags configuring signatures.
+type signatureFlags struct {
+	blockSize  int
+	strongSize int
+	weakName   string
+	hashName   string
+}
+
+func (f *signatureFlags) register(fs *flag.FlagSet) {
+	fs.IntVar(&f.blockSize, "b", 0, "block size, recommended for the basis length by default")
+	fs.IntVar(&f.strongSize, "s", 0, "strong size, recommended for the basis length by default")
+	fs.StringVar(&f.weakName, "weak", diff.Rollsum.String(), "weak hash (rollsum, rabinkarp)")
+	fs.StringVar(&f.hashName, "hash", "", "strong hash (md5, sha1, sha256, blake2b, md4), md5 by default or blake2b with -rdiff")
+}
+
+func (f *signatureFlags) options(rdiff bool) (diff.SignatureOptions, error) {
+	weakHash, err := diff.ParseWeakHash(f.weakName)
+	if err != nil {
+		return diff.SignatureOptions{}, err
+	}
+	strongHash := diff.MD5
+	if rdiff {
+		strongHash = diff.BLAKE2b
+	}
+	if f.hashName != "" {
+		if strongHash, err = diff.ParseStrongHash(f.hashName); err != nil {
+			return diff.SignatureOptions{}, err
+		}
+	}
+
+	if f.blockSize < 0 || uint64(f.blockSize) > math.MaxUint32 {
+		return diff.SignatureOptions{}, fmt.Errorf("block size must be in range (0, %d]", uint32(math.MaxUint32))
+	}
+	strongSize := f.strongSize
+	switch {
+	case strongSize < 0:
+		return diff.SignatureOptions{}, fmt.Errorf("strong size must be in range (0, %d]", strongHash.Size())
+	case strongSize > strongHash.Size():
+		strongSize = strongHash.Size()
+	}
+
+	opts := diff.SignatureOptions{
+		BlockSize:  uint32(f.blockSize),
+		StrongSize: byte(strongSize),
+		WeakHash:   weakHash,
+		StrongHash: strongHash,
+	}
+	if rdiff {
+		opts.Format = diff.Rdiff
+	}
+	return opts, nil
+}
+
+// deltaFlags are the flags configuring deltas.
+type deltaFlags struct {
+	rdiff    bool
+	compact  bool
+	compress bool
+	inOrder  bool
+}
+
+func (f *deltaFlags) register(fs *flag.FlagSet) {
+	fs.BoolVar(&f.rdiff, "rdiff", false, "write a librsync (rdiff) delta")
+	fs.BoolVar(&f.compact, "compact", false, "write instructions with the compact encoding")
+	fs.BoolVar(&f.compress, "compress", false, "compress instructions and literal data (flate)")
+	fs.BoolVar(&f.inOrder, "inorder", false, "never copy backwards, so the delta can be patched with a streamed basis")
+}
+
+func (f *deltaFlags) options() diff.DeltaOptions {
+	opts := diff.DeltaOptions{InOrder: f.inOrder}
+	if f.rdiff {
+		opts.Format = diff.Rdiff
+	}
+	if f.compact {
+		opts.Encoding = diff.CompactEncoding
+	}
+	if f.compress {
+		opts.Compression = diff.FlateCompression
+	}
+	return opts
+}
+
+// writeDelta writes the delta of the new file out to w, scanning segments of regular files concurrently.
+func writeDelta(opts diff.DeltaOptions, sig *diff.Signature, newInput *input, w io.Writer) error {
+	if newInput.size >= 0 {
+		return opts.WriteDeltaAt(sig, newInput, newInput.size, w)
+	}
+	// e.g. a pipe
+	return opts.WriteDelta(sig, newInput, w)
+}
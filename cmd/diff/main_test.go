@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/kuba--/diff"
+	"github.com/stretchr/testify/require"
+)
+
+// runMainEnv makes the test binary run main instead of the tests, see run.
+const runMainEnv = "DIFF_TEST_RUN_MAIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(runMainEnv) != "" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// run runs the command with args and stdin, and returns its stdout, stderr and exit code.
+func run(t *testing.T, stdin []byte, args ...string) (stdout, stderr []byte, code int) {
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), runMainEnv+"=1")
+	cmd.Stdin = bytes.NewReader(stdin)
+	outBuf, errBuf := bytes.NewBuffer(nil), bytes.NewBuffer(nil)
+	cmd.Stdout, cmd.Stderr = outBuf, errBuf
+
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		code = exitErr.ExitCode()
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return outBuf.Bytes(), errBuf.Bytes(), code
+}
+
+// testFiles writes a basis and a new file (sharing most of their blocks) to dir.
+func testFiles(t *testing.T, dir string) (basis, newData []byte) {
+	rnd := rand.New(rand.NewSource(1))
+	basis = make([]byte, 64*1024)
+	rnd.Read(basis)
+	newData = append([]byte(`prefix`), basis[:30000]...)
+	newData = append(newData, `middle`...)
+	newData = append(newData, basis[40000:]...)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "basis"), basis, 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "new"), newData, 0o644))
+	return basis, newData
+}
+
+func TestPipes(t *testing.T) {
+	require := require.New(t)
+
+	dir := t.TempDir()
+	basis, newData := testFiles(t, dir)
+	path := func(name string) string { return filepath.Join(dir, name) }
+
+	// signature | delta | patch
+	sig, stderr, code := run(t, basis, "signature", "-b", "512", "-", "-")
+	require.Zero(code, "%s", stderr)
+	require.NoError(os.WriteFile(path("sig"), sig, 0o644))
+	delta, stderr, code := run(t, newData, "delta", path("sig"), "-", "-")
+	require.Zero(code, "%s", stderr)
+	recreated, stderr, code := run(t, delta, "patch", "-verify", path("basis"), "-", "-")
+	require.Zero(code, "%s", stderr)
+	require.Equal(newData, recreated)
+
+	// the signature from stdin
+	delta2, stderr, code := run(t, sig, "delta", "-", path("new"), "-")
+	require.Zero(code, "%s", stderr)
+	recreated, stderr, code = run(t, delta2, "patch", path("basis"), "-", "-")
+	require.Zero(code, "%s", stderr)
+	require.Equal(newData, recreated)
+
+	// diff, and patch with a streamed basis
+	delta, stderr, code = run(t, nil, "diff", "-inorder", path("basis"), path("new"), "-")
+	require.Zero(code, "%s", stderr)
+	require.NoError(os.WriteFile(path("delta"), delta, 0o644))
+	recreated, stderr, code = run(t, basis, "patch", "-verify", "-stream", "-", path("delta"), "-")
+	require.Zero(code, "%s", stderr)
+	require.Equal(newData, recreated)
+
+	// in place, with the delta from stdin
+	require.NoError(os.WriteFile(path("inplace"), basis, 0o644))
+	_, stderr, code = run(t, delta, "patch", "-verify", "-inplace", path("inplace"), "-")
+	require.Zero(code, "%s", stderr)
+	b, err := os.ReadFile(path("inplace"))
+	require.NoError(err)
+	require.Equal(newData, b)
+
+	// -v reports on stderr only
+	recreated, stderr, code = run(t, delta, "patch", "-v", path("basis"), "-", "-")
+	require.Zero(code)
+	require.Equal(newData, recreated)
+	require.Contains(string(stderr), "patch: ")
+}
+
+func TestExitCodes(t *testing.T) {
+	require := require.New(t)
+
+	dir := t.TempDir()
+	basis, _ := testFiles(t, dir)
+	path := func(name string) string { return filepath.Join(dir, name) }
+	delta, _, code := run(t, nil, "diff", path("basis"), path("new"), "-")
+	require.Zero(code)
+	require.NoError(os.WriteFile(path("delta"), delta, 0o644))
+	// other is a basis of the same length, but different content
+	other := bytes.Clone(basis)
+	copy(other[1000:], `changed`)
+	require.NoError(os.WriteFile(path("other"), other, 0o644))
+	require.NoError(os.WriteFile(path("short"), basis[:1000], 0o644))
+
+	for _, c := range []struct {
+		stdin []byte
+		args  []string
+		code  int
+	}{
+		{nil, nil, exitUsage},
+		{nil, []string{"unknown"}, exitUsage},
+		{nil, []string{"delta", "-unknown", path("sig"), path("new"), "-"}, exitUsage},
+		{nil, []string{"delta", path("sig"), path("new")}, exitUsage},
+		{nil, []string{"diff", "-", "-", "-"}, exitUsage},
+		{nil, []string{"patch", "-", path("delta"), "-"}, exitUsage},
+		{nil, []string{"delta", "-lowmem", "-", path("new"), "-"}, exitUsage},
+		{nil, []string{"signature", "-b", "-1", path("basis"), "-"}, exitUsage},
+		{nil, []string{"signature", "-h"}, 0},
+		{nil, []string{"signature", path("missing"), "-"}, exitError},
+		{delta[:len(delta)/2], []string{"patch", path("basis"), "-", "-"}, exitError},
+		{delta, []string{"patch", path("short"), "-", "-"}, exitError},
+		{delta, []string{"patch", path("other"), "-", "-"}, exitMismatch},
+		{other, []string{"patch", "-verify", "-stream", "-", path("delta"), "-"}, exitMismatch},
+	} {
+		_, stderr, code := run(t, c.stdin, c.args...)
+		require.Equal(c.code, code, "%v: %s", c.args, stderr)
+		if code != 0 {
+			require.NotEmpty(stderr, "%v", c.args)
+		}
+	}
+
+	// a recreated file which does not verify is removed
+	_, stderr, code := run(t, nil, "patch", "-verify", path("other"), path("delta"), path("recreated"))
+	require.Equal(exitMismatch, code)
+	require.Contains(string(stderr), diff.ErrChecksumMismatch.Error())
+	require.NoFileExists(path("recreated"))
+}
+
+func TestOneStdin(t *testing.T) {
+	require := require.New(t)
+
+	require.NoError(oneStdin("a", "b"))
+	require.NoError(oneStdin("-", "b"))
+	require.Error(oneStdin("-", "-"))
+}
+
+func TestPeekDeltaHeader(t *testing.T) {
+	require := require.New(t)
+
+	sig, err := diff.SignatureOptions{BlockSize: 16, StrongSize: 8}.NewSignature(bytes.NewReader(bytes.Repeat([]byte(`ala ma kota,`), 10)))
+	require.NoError(err)
+	delta := bytes.NewBuffer(nil)
+	require.NoError(diff.WriteDelta(sig, bytes.NewReader(bytes.Repeat([]byte(`kot ma ale,`), 10)), delta))
+
+	// a regular file, and a pipe
+	name := filepath.Join(t.TempDir(), "delta")
+	require.NoError(os.WriteFile(name, delta.Bytes(), 0o644))
+	regular, err := openInput(name)
+	require.NoError(err)
+	defer regular.Close()
+
+	pr, pw, err := os.Pipe()
+	require.NoError(err)
+	go func() {
+		pw.Write(delta.Bytes())
+		pw.Close()
+	}()
+	pipe := &input{file: pr, size: -1}
+	defer pipe.Close()
+
+	for _, in := range []*input{regular, pipe} {
+		header, r, err := peekDeltaHeader(in)
+		require.NoError(err)
+		require.EqualValues(1, header.Version)
+		require.EqualValues(16, header.BlockSize)
+		// the whole delta is still read
+		b, err := io.ReadAll(r)
+		require.NoError(err)
+		require.Equal(delta.Bytes(), b)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"time"
+
+	"github.com/kuba--/diff"
+)
+
+func patchCommand(args []string) {
+	var (
+		verify  bool
+		stream  bool
+		inPlace bool
+		workers int
+	)
+	fs := newFlagSet("patch", "[-verify] [-stream | -workers n] [-v] basis-file|- delta-file|- recreated-file|-\n"+
+		os.Args[0]+" patch [-verify] [-v] -inplace basis-file delta-file|-")
+	fs.BoolVar(&verify, "verify", false, "verify basis and recreated file against the digests recorded in the delta")
+	fs.BoolVar(&stream, "stream", false, "read the basis forward only (e.g. from a pipe), the delta must be written with -inorder")
+	fs.BoolVar(&inPlace, "inplace", false, "recreate the file in the basis file itself")
+	fs.IntVar(&workers, "workers", 0, "number of concurrent basis copies, GOMAXPROCS by default")
+	parse(fs, args, func() bool {
+		if inPlace {
+			return !stream && fs.NArg() == 2
+		}
+		return fs.NArg() == 3
+	})
+	if err := oneStdin(fs.Arg(0), fs.Arg(1)); err != nil {
+		usageError(fs, err)
+	}
+	if fs.Arg(0) == stdio && !stream {
+		usageError(fs, errors.New("the basis can only be read from stdin with -stream"))
+	}
+
+	start := time.Now()
+	deltaInput, err := openInput(fs.Arg(1))
+	if err != nil {
+		fail(err)
+	}
+	defer deltaInput.Close()
+
+	opts := diff.PatchOptions{Workers: workers, VerifyBasis: verify}
+	deltaReader := deltaInput.reader()
+	if verify {
+		var header diff.DeltaHeader
+		if header, deltaReader, err = peekDeltaHeader(deltaInput); err != nil {
+			fail(err)
+		}
+		// legacy and librsync deltas do not record digests
+		if header.Version == 0 {
+			exit(exitMismatch, errors.New("delta does not record digests"))
+		}
+	}
+
+	if inPlace {
+		basisFile, err := os.OpenFile(fs.Arg(0), os.O_RDWR, 0)
+		if err != nil {
+			fail(err)
+		}
+		defer basisFile.Close()
+
+		// the basis is lost once it was modified, so it has to be verified up front (with -verify)
+		stop := progress("delta", deltaInput)
+		err = opts.PatchInPlace(basisFile, deltaReader)
+		stop()
+		if err != nil {
+			fail(err)
+		}
+		summary(start, "%d delta bytes read", deltaInput.n.Load())
+		return
+	}
+
+	basisInput, err := openInput(fs.Arg(0))
+	if err != nil {
+		fail(err)
+	}
+	defer basisInput.Close()
+
+	recreatedOutput, err := createOutput(fs.Arg(2))
+	if err != nil {
+		fail(err)
+	}
+	defer recreatedOutput.Close()
+
+	stop := progress("delta", deltaInput)
+	switch {
+	case stream:
+		w := bufio.NewWriter(recreatedOutput)
+		if err = opts.PatchStream(basisInput.reader(), deltaReader, w); err == nil {
+			err = w.Flush()
+		}
+	case recreatedOutput.file == os.Stdout:
+		// stdout is written sequentially
+		w := bufio.NewWriter(recreatedOutput)
+		if err = opts.PatchReaderAt(basisInput, deltaReader, w); err == nil {
+			err = w.Flush()
+		}
+	default:
+		// the recreated file was created for reading and writing, so it is read back and checked
+		opts.VerifyNew = true
+		err = opts.PatchAt(basisInput, deltaReader, recreatedOutput.file)
+	}
+	stop()
+	if err != nil {
+		if verify && errors.Is(err, diff.ErrChecksumMismatch) && recreatedOutput.file != os.Stdout {
+			recreatedOutput.Close()
+			os.Remove(recreatedOutput.file.Name())
+		}
+		fail(err)
+	}
+	summary(start, "%d basis bytes and %d delta bytes read", basisInput.n.Load(), deltaInput.n.Load())
+}
+
+// peekDeltaHeader reads the header of the delta, and returns it with a reader of the whole delta.
+// Regular files are read at their start, other inputs (e.g. pipes) are read through a buffer of the header.
+func peekDeltaHeader(in *input) (diff.DeltaHeader, io.Reader, error) {
+	if in.size >= 0 {
+		header, err := diff.ReadDeltaHeader(io.NewSectionReader(in.file, 0, in.size))
+		return header, in.reader(), err
+	}
+
+	buf := bytes.NewBuffer(nil)
+	header, err := diff.ReadDeltaHeader(io.TeeReader(in, buf))
+	return header, io.MultiReader(buf, in), err
+}
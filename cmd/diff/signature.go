@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bufio"
+	"time"
+
+	"github.com/kuba--/diff"
+)
+
+func signatureCommand(args []string) {
+	var (
+		sigFlags signatureFlags
+		rdiff    bool
+		workers  int
+	)
+	fs := newFlagSet("signature", "[-b block size] [-s strong size] [-weak rollsum|rabinkarp] [-hash md5|sha1|sha256|blake2b|md4] [-rdiff] [-workers n] [-v] basis-file|- sig-file|-")
+	sigFlags.register(fs)
+	fs.BoolVar(&rdiff, "rdiff", false, "write a librsync (rdiff) signature")
+	fs.IntVar(&workers, "workers", 0, "number of goroutines checksumming blocks, GOMAXPROCS by default")
+	parse(fs, args, func() bool { return fs.NArg() == 2 })
+
+	opts, err := sigFlags.options(rdiff)
+	if err != nil {
+		usageError(fs, err)
+	}
+	opts.Workers = workers
+
+	start := time.Now()
+	basisInput, err := openInput(fs.Arg(0))
+	if err != nil {
+		fail(err)
+	}
+	defer basisInput.Close()
+
+	sigOutput, err := createOutput(fs.Arg(1))
+	if err != nil {
+		fail(err)
+	}
+	defer sigOutput.Close()
+
+	stop := progress("basis", basisInput)
+	w := bufio.NewWriter(sigOutput)
+	var sig *diff.Signature
+	if basisInput.size >= 0 {
+		sig, err = opts.WriteSignatureAt(basisInput, basisInput.size, w)
+	} else {
+		// e.g. a pipe
+		sig, err = opts.WriteSignature(basisInput, w)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	stop()
+	if err != nil {
+		fail(err)
+	}
+	summary(start, "%d basis bytes read, %d signature bytes written (%d blocks of %d bytes, strong size %d)",
+		basisInput.n.Load(), sigOutput.n.Load(), sig.BlockCount(), sig.BlockSize, sig.StrongSize)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/kuba--/diff"
+)
+
+var blocks bool
+
+func main() {
+	flag.BoolVar(&blocks, "blocks", false, "list every block with its offset, size and checksums")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "%s [-blocks] sig-file|-\n", flag.CommandLine.Name())
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	args := flag.Args()
+	if len(args) != 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	sig, err := openSignature(args[0])
+	if err != nil {
+		fail(err)
+	}
+	stats, err := sig.Stats()
+	if err != nil {
+		fail(err)
+	}
+
+	_, exact := sig.Length()
+	estimated := ""
+	if !exact {
+		estimated = " (not recorded, assuming a full final block)"
+	}
+	if sig.Format == diff.Native {
+		fmt.Printf("format:                  %v (version %d)\n", sig.Format, sig.Version)
+	} else {
+		fmt.Printf("format:                  %v\n", sig.Format)
+	}
+	fmt.Printf("weak hash:               %v\n", sig.WeakHash)
+	fmt.Printf("strong hash:             %v\n", sig.StrongHash)
+	fmt.Printf("block size:              %d\n", sig.BlockSize)
+	fmt.Printf("strong size:             %d\n", sig.StrongSize)
+	fmt.Printf("basis length:            %d%s\n", stats.Length, estimated)
+	if len(sig.BasisDigest) > 0 {
+		fmt.Printf("basis digest:            %x\n", sig.BasisDigest)
+	}
+	fmt.Printf("blocks:                  %d\n", stats.Blocks)
+	fmt.Printf("weak checksums:          %d\n", stats.WeakChecksums)
+	fmt.Printf("weak collisions:         %d\n", stats.WeakCollisions)
+	fmt.Printf("duplicate blocks:        %d\n", stats.DuplicateBlocks)
+	fmt.Printf("max blocks per weak:     %d\n", stats.MaxWeakBlocks)
+	fmt.Printf("false match probability: %.3g\n", stats.FalseMatchProbability)
+
+	if blocks {
+		fmt.Println()
+		err = sig.Blocks(func(n int, b diff.Block) bool {
+			fmt.Printf("%d\t%d\t%d\t%08x\t%x\n", n, b.Offset, b.Size, b.Weak, b.Strong)
+			return true
+		})
+		if err != nil {
+			fail(err)
+		}
+	}
+}
+
+// openSignature opens the named signature file, - reads the whole signature from stdin.
+func openSignature(name string) (*diff.Signature, error) {
+	if name == "-" {
+		return diff.ReadSignature(bufio.NewReader(os.Stdin))
+	}
+
+	sigFile, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	// strong checksums are only read for blocks sharing their weak checksum, so the file is kept open
+	return diff.OpenSignature(sigFile)
+}
+
+// fail prints err on stderr, and exits.
+func fail(err error) {
+	fmt.Fprintf(os.Stderr, "%s: %v\n", flag.CommandLine.Name(), err)
+	os.Exit(2)
+}
@@ -0,0 +1,84 @@
+package diff
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// compact encoding commands
+const (
+	// compactOpEnd is followed by the uvarint length of the recreated file.
+	compactOpEnd = byte(0x0)
+	// compactOpLiteral is followed by the uvarint size, and the data.
+	compactOpLiteral = byte(0x1)
+	// compactOpCopy is followed by the varint offset, relative to the end of the previous copy, and the uvarint size.
+	compactOpCopy = byte(0x2)
+)
+
+// compactWriter writes instructions in the compact encoding.
+type compactWriter struct {
+	io.Writer
+	// copyEnd is the end of the previous copy in the basis.
+	copyEnd uint64
+}
+
+func (w *compactWriter) writeInstruction(i *DeltaInstruction) error {
+	var b [1 + 2*binary.MaxVarintLen64]byte
+	switch i.From {
+	case FromNew:
+		b[0] = compactOpLiteral
+		p := binary.AppendUvarint(b[:1], i.Size)
+		if _, err := w.Write(p); err != nil {
+			return err
+		}
+		_, err := w.Write(i.Data)
+		return err
+
+	case FromOld:
+		b[0] = compactOpCopy
+		p := binary.AppendVarint(b[:1], int64(i.Offset-w.copyEnd))
+		p = binary.AppendUvarint(p, i.Size)
+		w.copyEnd = i.Offset + i.Size
+		_, err := w.Write(p)
+		return err
+	}
+	return fmt.Errorf("invalid delta instruction: %#x", i.From)
+}
+
+func (w *compactWriter) writeEnd(length uint64) error {
+	var b [1 + binary.MaxVarintLen64]byte
+	b[0] = compactOpEnd
+	_, err := w.Write(binary.AppendUvarint(b[:1], length))
+	return err
+}
+
+// readCompactInstruction reads a single instruction in the compact encoding, the end command is returned as the FromEnd trailer.
+// copyEnd is the end of the previous copy, and it is updated by copies.
+func readCompactInstruction(r io.ByteReader, copyEnd *uint64) (header DeltaInstructionHeader, err error) {
+	op, err := r.ReadByte()
+	if err != nil {
+		return
+	}
+
+	switch op {
+	case compactOpEnd:
+		header.From = FromEnd
+		header.Size, err = binary.ReadUvarint(r)
+	case compactOpLiteral:
+		header.From = FromNew
+		header.Size, err = binary.ReadUvarint(r)
+	case compactOpCopy:
+		var offset int64
+		if offset, err = binary.ReadVarint(r); err != nil {
+			return header, noEOF(err)
+		}
+		header.From = FromOld
+		header.Offset = *copyEnd + uint64(offset)
+		header.Size, err = binary.ReadUvarint(r)
+		*copyEnd = header.Offset + header.Size
+	default:
+		err = fmt.Errorf("invalid delta instruction: %#x", op)
+	}
+	return header, noEOF(err)
+}
@@ -0,0 +1,104 @@
+package diff
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompactInstruction(t *testing.T) {
+	require := require.New(t)
+
+	delta := []*DeltaInstruction{
+		{DeltaInstructionHeader: DeltaInstructionHeader{From: FromOld, Offset: 1 << 40, Size: 11}},
+		// backward
+		{DeltaInstructionHeader: DeltaInstructionHeader{From: FromOld, Offset: 11, Size: 1 << 20}},
+		{DeltaInstructionHeader: DeltaInstructionHeader{From: FromNew, Size: 3}, Data: []byte(`abc`)},
+		// right after the previous copy
+		{DeltaInstructionHeader: DeltaInstructionHeader{From: FromOld, Offset: 11 + 1<<20, Size: 1}},
+	}
+
+	buf := bytes.NewBuffer(nil)
+	w := &compactWriter{Writer: buf}
+	for _, i := range delta {
+		require.NoError(w.writeInstruction(i))
+	}
+	require.NoError(w.writeEnd(42))
+	// {op: 1 byte, offset: 1 byte, size: 1 byte}
+	require.Equal([]byte{compactOpCopy, 0x0, 0x1}, buf.Bytes()[len(buf.Bytes())-5:len(buf.Bytes())-2])
+
+	var copyEnd uint64
+	for _, i := range delta {
+		header, err := readCompactInstruction(buf, &copyEnd)
+		require.NoError(err)
+		require.Equal(i.DeltaInstructionHeader, header)
+		if header.From == FromNew {
+			require.Equal(i.Data, buf.Next(int(header.Size)))
+		}
+	}
+	header, err := readCompactInstruction(buf, &copyEnd)
+	require.NoError(err)
+	require.Equal(DeltaInstructionHeader{From: FromEnd, Size: 42}, header)
+
+	_, err = readCompactInstruction(bytes.NewBuffer([]byte{0x3}), &copyEnd)
+	require.Error(err)
+	_, err = readCompactInstruction(bytes.NewBuffer([]byte{compactOpCopy, 0x80}), &copyEnd)
+	require.Error(err)
+}
+
+func TestCompactDelta(t *testing.T) {
+	require := require.New(t)
+
+	const (
+		strongSize = byte(8)
+		blockSize  = uint32(11)
+
+		oldText = `ala ma kotakot ma ale,lal al ala,tyl e`
+		newText = `kot ma ale,ala ma kota,lal al ala,tyl e`
+	)
+
+	sig, err := WriteSignature(strings.NewReader(oldText), bytes.NewBuffer(nil), blockSize, strongSize)
+	require.NoError(err)
+
+	fixed := bytes.NewBuffer(nil)
+	err = DeltaOptions{Encoding: FixedEncoding}.WriteDelta(sig, strings.NewReader(newText), fixed)
+	require.NoError(err)
+
+	compact := bytes.NewBuffer(nil)
+	err = DeltaOptions{Encoding: CompactEncoding}.WriteDelta(sig, strings.NewReader(newText), compact)
+	require.NoError(err)
+	require.Less(compact.Len(), fixed.Len())
+
+	header, err := ReadDeltaHeader(bytes.NewReader(compact.Bytes()))
+	require.NoError(err)
+	require.Equal(CompactEncoding, header.Encoding)
+
+	d1, err := ReadDelta(bytes.NewReader(fixed.Bytes()))
+	require.NoError(err)
+	d2, err := ReadDelta(bytes.NewReader(compact.Bytes()))
+	require.NoError(err)
+	require.EqualValues(d1, d2)
+
+	buf := bytes.NewBuffer(nil)
+	err = Patch(strings.NewReader(oldText), bytes.NewReader(compact.Bytes()), buf)
+	require.NoError(err)
+	require.EqualValues(newText, buf.String())
+
+	// not an io.ByteReader
+	buf.Reset()
+	err = Patch(strings.NewReader(oldText), struct{ io.Reader }{bytes.NewReader(compact.Bytes())}, buf)
+	require.NoError(err)
+	require.EqualValues(newText, buf.String())
+
+	b := compact.Bytes()
+	for n := len(b) - 1; n > 0; n-- {
+		_, err = ReadDelta(bytes.NewReader(b[:n]))
+		require.Errorf(err, "truncated at %d", n)
+	}
+
+	err = DeltaOptions{Encoding: DeltaEncoding(0xff)}.WriteDelta(sig, strings.NewReader(newText), bytes.NewBuffer(nil))
+	require.Error(err)
+}
@@ -3,17 +3,74 @@ package diff
 import (
 	"bufio"
 	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"hash"
 	"io"
+	"math"
+	"os"
 )
 
 const (
 	FromOld = byte(0x0)
 	FromNew = byte(0x1)
+	// FromEnd marks the end-of-delta trailer, its Size is the length of the recreated file.
+	FromEnd = byte(0xff)
+)
+
+const (
+	// deltaMagic starts every versioned delta ("ddlt").
+	// Legacy deltas start with an instruction (FromOld or FromNew), so both formats can be told apart.
+	deltaMagic   = uint32(0x64646c74)
+	deltaVersion = byte(1)
+
+	// UnknownLength is recorded in the delta header when the length of the new file is not known up front.
+	UnknownLength = ^uint64(0)
+
+	// maxLiteralSize is the size literal data is merged up to, before it is written out.
+	maxLiteralSize = 1024 * 1024
+)
+
+const (
+	// FixedEncoding writes every instruction as a fixed, 17 bytes record.
+	FixedEncoding = DeltaEncoding(0x0)
+	// CompactEncoding writes instructions with varints, and copy offsets relative to the end of the previous copy.
+	CompactEncoding = DeltaEncoding(0x1)
+)
+
+const (
+	// NoCompression leaves instructions uncompressed.
+	NoCompression = Compression(0x0)
+	// FlateCompression compresses instructions, literal data and the trailer as a single (raw) DEFLATE stream.
+	FlateCompression = Compression(0x1)
 )
 
 type (
 	Delta = []*DeltaInstruction
 
+	// DeltaEncoding is the encoding of instructions in a (native) delta.
+	DeltaEncoding byte
+
+	// Compression is the compression of instructions in a (native) delta.
+	Compression byte
+
+	DeltaHeader struct {
+		Format Format
+		// Version is 0 for the legacy (headerless) format, and librsync deltas.
+		Version    byte
+		BlockSize  uint32
+		StrongHash StrongHash
+		// Length is the expected length of the recreated file, or UnknownLength.
+		Length uint64
+		// BasisDigest is the digest of the basis the delta applies to, if the signature recorded it.
+		BasisDigest []byte
+		// Encoding is the encoding of instructions.
+		Encoding DeltaEncoding
+		// Compression is the compression of everything after the header.
+		Compression Compression
+	}
+
 	DeltaInstruction struct {
 		DeltaInstructionHeader
 		Data []byte
@@ -24,70 +81,172 @@ type (
 		Offset uint64
 		Size   uint64
 	}
+
+	// instructionWriter encodes delta instructions in a particular format.
+	instructionWriter interface {
+		writeInstruction(i *DeltaInstruction) error
+		// writeEnd writes the trailer.
+		writeEnd(length uint64) error
+	}
+
+	// nativeWriter writes instructions in the native format.
+	nativeWriter struct {
+		io.Writer
+	}
+
+	// deltaReader reads the delta header (if any), instructions and the trailer.
+	deltaReader struct {
+		io.Reader
+		header DeltaHeader
+		// length is the number of bytes recreated by the instructions read so far.
+		length uint64
+		// digest is the digest of the recreated file, read from the trailer.
+		digest []byte
+		// copyEnd is the end of the previous copy, for the compact encoding.
+		copyEnd uint64
+		// offset is the number of bytes read so far (including the header), index the number of instructions.
+		offset int64
+		index  int
+		// start is the offset of the last instruction.
+		start int64
+		// err is the last error of the underlying reader.
+		err error
+	}
+
+	// DeltaOptions configures how a delta is written.
+	// The zero value writes native deltas with the FixedEncoding and NoCompression.
+	//
+	// SignatureOptions, DeltaOptions and PatchOptions do not depend on package level state, so differently configured
+	// options can be used concurrently. The exception are legacy signatures: they do not record their strong hash,
+	// so writing a delta against one checksums blocks with NewHash.
+	DeltaOptions struct {
+		// Format is the wire format of the delta, librsync deltas support neither encodings nor compression.
+		Format      Format
+		Encoding    DeltaEncoding
+		Compression Compression
+		// BufferSize is the size of the buffer the new file is read into (at least two blocks), 0 uses 256KB.
+		BufferSize int
+		// InOrder only matches blocks past the previous copy, so copy offsets never go backwards
+		// and the delta can be applied with a forward-only basis (see PatchStream).
+		InOrder bool
+		// Workers is the number of goroutines scanning segments of the new file in WriteDeltaAt, 0 uses GOMAXPROCS.
+		Workers int
+		// NoDigest leaves the digest of the new file out of native deltas, so the recreated file is not checked.
+		// WriteDeltaAt hashes the whole new file in a single goroutine, which bounds the speedup of Workers.
+		NoDigest bool
+	}
 )
 
+// WriteDelta writes the delta between the basis (described by signature) and newReader out to deltaWriter.
+// Instructions are written with the FixedEncoding.
 func WriteDelta(signature *Signature, newReader io.Reader, deltaWriter io.Writer) error {
-	rd := bufio.NewReaderSize(newReader, int(signature.BlockSize))
-	buf := newRollBuffer(int(signature.BlockSize))
-	h := NewHash()
+	return DeltaOptions{}.WriteDelta(signature, newReader, deltaWriter)
+}
 
-	i := &DeltaInstruction{}
-	for {
-		in, err := rd.ReadByte()
-		eof := err == io.EOF
-		if err != nil {
-			if !eof {
-				return err
-			}
-			// EOF
-		} else {
-			out, overwrote := buf.writeByte(in)
-			if buf.count < buf.size {
-				continue
-			}
-			if overwrote {
-				if err = i.append(deltaWriter, &DeltaInstruction{
-					DeltaInstructionHeader: DeltaInstructionHeader{From: FromNew, Size: uint64(1)},
-					Data:                   []byte{out},
-				}); err != nil {
-					return err
-				}
-			}
+// WriteDelta writes the delta between the basis (described by signature) and newReader out to deltaWriter.
+func (o DeltaOptions) WriteDelta(signature *Signature, newReader io.Reader, deltaWriter io.Writer) error {
+	return o.writeDelta(signature, readerLength(newReader), func(w instructionWriter, digest hash.Hash) (uint64, error) {
+		r := newReader
+		if digest != nil {
+			r = io.TeeReader(newReader, digest)
 		}
+		return writeDeltaInstructions(signature, nil, r, w, o)
+	}, deltaWriter)
+}
 
-		weak := buf.checksum32()
-		strong, offset, blocksize, ok := signature.Lookup(weak)
-		if ok {
-			// fmt.Printf("LOOKUP(%x) => [%v]: Offset:%d, Size:%d\n", weak, ok, offset, blocksize)
-			h.Reset()
-			h.Write(buf.bytes())
-			// from old
-			if bytes.Equal(strong, h.Sum(nil)[:signature.StrongSize]) {
-				if err = i.append(deltaWriter, &DeltaInstruction{
-					DeltaInstructionHeader: DeltaInstructionHeader{From: FromOld,
-						Offset: offset,
-						Size:   uint64(blocksize),
-					},
-					Data: []byte{},
-				}); err != nil {
-					return err
-				}
-				buf.reset()
-			}
-		}
-		if eof {
-			i.writeTo(deltaWriter)
-			break
+// deltaScanner writes the instructions recreating the new file out to w, and returns the length of the new file.
+// digest, unless nil, is written the whole new file.
+type deltaScanner func(w instructionWriter, digest hash.Hash) (uint64, error)
+
+// writeDelta writes the delta of a new file of newLength bytes (or UnknownLength), with instructions from scan.
+func (o DeltaOptions) writeDelta(signature *Signature, newLength uint64, scan deltaScanner, deltaWriter io.Writer) error {
+	switch o.Format {
+	case Native:
+		return writeNativeDelta(signature, newLength, scan, deltaWriter, o)
+	case Rdiff:
+		if o.Encoding != FixedEncoding || o.Compression != NoCompression {
+			return fmt.Errorf("%w: librsync deltas support neither encodings nor compression", ErrInvalidOptions)
 		}
+		return writeRdiffDelta(scan, deltaWriter)
+	}
+	return fmt.Errorf("%w: unsupported delta format: %v", ErrInvalidOptions, o.Format)
+}
+
+func writeNativeDelta(signature *Signature, newLength uint64, scan deltaScanner, deltaWriter io.Writer, o DeltaOptions) error {
+	if o.Encoding != FixedEncoding && o.Encoding != CompactEncoding {
+		return fmt.Errorf("%w: unsupported delta encoding: %d", ErrInvalidOptions, o.Encoding)
+	}
+	if o.Compression != NoCompression && o.Compression != FlateCompression {
+		return fmt.Errorf("%w: unsupported delta compression: %d", ErrInvalidOptions, o.Compression)
+	}
+
+	header := DeltaHeader{
+		Version:     deltaVersion,
+		BlockSize:   signature.BlockSize,
+		StrongHash:  signature.StrongHash,
+		Length:      newLength,
+		BasisDigest: signature.BasisDigest,
+		Encoding:    o.Encoding,
+		Compression: o.Compression,
+	}
+	if err := writeDeltaHeader(deltaWriter, header); err != nil {
+		return err
+	}
+
+	// everything after the header is compressed
+	var zw *flate.Writer
+	if o.Compression == FlateCompression {
+		zw, _ = flate.NewWriter(deltaWriter, flate.DefaultCompression)
+		deltaWriter = zw
+	}
+
+	var w instructionWriter = nativeWriter{deltaWriter}
+	if o.Encoding == CompactEncoding {
+		w = &compactWriter{Writer: deltaWriter}
 	}
 
+	var digest hash.Hash
+	if !o.NoDigest {
+		digest = header.StrongHash.New()
+	}
+	length, err := scan(w, digest)
+	if err != nil {
+		return err
+	}
+
+	if header.Length != UnknownLength && header.Length != length {
+		if length < header.Length {
+			return fmt.Errorf("%w: expected %d, read %d: %w", ErrLengthChanged, header.Length, length, io.ErrUnexpectedEOF)
+		}
+		return fmt.Errorf("%w: expected %d, read %d", ErrLengthChanged, header.Length, length)
+	}
+	if err = w.writeEnd(length); err != nil {
+		return err
+	}
+	var sum []byte
+	if digest != nil {
+		sum = digest.Sum(nil)
+	}
+	if err = writeDigest(deltaWriter, sum); err != nil {
+		return err
+	}
+	if zw != nil {
+		return zw.Close()
+	}
 	return nil
 }
 
+// ReadDelta reads all instructions from r.
+// Legacy deltas, without the versioned header and trailer, and librsync deltas are accepted as well.
 func ReadDelta(r io.Reader) (delta Delta, err error) {
+	dr, err := newDeltaReader(r)
+	if err != nil {
+		return nil, err
+	}
+
 	for {
 		var i DeltaInstruction
-		i.DeltaInstructionHeader, err = ReadDeltaInstructionHeader(r)
+		i.DeltaInstructionHeader, err = dr.next()
 		if err != nil {
 			if err == io.EOF {
 				break
@@ -96,10 +255,12 @@ func ReadDelta(r io.Reader) (delta Delta, err error) {
 		}
 
 		if i.From == FromNew && i.Size > 0 {
-			i.Data = make([]byte, i.Size)
-			if _, err = r.Read(i.Data); err != nil {
+			// the size is not trusted (with corrupt deltas), so the data is buffered as it is read
+			buf := bytes.NewBuffer(nil)
+			if err = dr.copyData(buf, i.Size, nil); err != nil {
 				return nil, err
 			}
+			i.Data = buf.Bytes()
 		}
 		delta = append(delta, &i)
 	}
@@ -107,45 +268,333 @@ func ReadDelta(r io.Reader) (delta Delta, err error) {
 	return delta, nil
 }
 
+// ReadDeltaHeader reads the delta header from r.
+// Legacy deltas have no header, in which case a zero header (Version 0) is returned.
+// r may be read past the header.
+func ReadDeltaHeader(r io.Reader) (DeltaHeader, error) {
+	dr, err := newDeltaReader(r)
+	if err != nil {
+		return DeltaHeader{}, err
+	}
+	return dr.header, nil
+}
+
+// ReadDeltaInstructionHeader reads a single instruction header (or the trailer) from r.
+// It returns io.EOF only if r ends right before the header, and io.ErrUnexpectedEOF if the header is truncated.
 func ReadDeltaInstructionHeader(r io.Reader) (header DeltaInstructionHeader, err error) {
 	var b [1 + 8 + 8]byte
-	if _, err = r.Read(b[:]); err != nil {
+	if _, err = io.ReadFull(r, b[:]); err != nil {
 		return
 	}
 
 	header.From = b[0]
-	header.Offset = ByteOrder.Uint64(b[1:9])
-	header.Size = ByteOrder.Uint64(b[9:])
+	header.Offset = byteOrder.Uint64(b[1:9])
+	header.Size = byteOrder.Uint64(b[9:])
+	if header.From != FromOld && header.From != FromNew && header.From != FromEnd {
+		err = fmt.Errorf("invalid delta instruction: %#x", header.From)
+	}
 	return
 }
 
-func (i *DeltaInstruction) append(w io.Writer, next *DeltaInstruction) error {
+func (e DeltaEncoding) String() string {
+	switch e {
+	case FixedEncoding:
+		return "fixed"
+	case CompactEncoding:
+		return "compact"
+	}
+	return fmt.Sprintf("DeltaEncoding(%d)", byte(e))
+}
+
+func (c Compression) String() string {
+	switch c {
+	case NoCompression:
+		return "none"
+	case FlateCompression:
+		return "flate"
+	}
+	return fmt.Sprintf("Compression(%d)", byte(c))
+}
+
+func writeDeltaHeader(w io.Writer, header DeltaHeader) error {
+	var b [4 + 1 + 4 + 1 + 8]byte
+	// magic
+	byteOrder.PutUint32(b[:4], deltaMagic)
+	// version
+	b[4] = header.Version
+	// block size
+	byteOrder.PutUint32(b[5:9], header.BlockSize)
+	// strong hash
+	b[9] = byte(header.StrongHash)
+	// length
+	byteOrder.PutUint64(b[10:], header.Length)
+
+	if _, err := w.Write(b[:]); err != nil {
+		return err
+	}
+	// basis digest
+	if err := writeDigest(w, header.BasisDigest); err != nil {
+		return err
+	}
+	// encoding & compression
+	_, err := w.Write([]byte{byte(header.Encoding), byte(header.Compression)})
+	return err
+}
+
+// newDeltaReader reads the delta header, or falls back to the legacy format if r does not start with a magic.
+// Truncated, corrupt and unsupported headers are returned as a CorruptDeltaError.
+func newDeltaReader(r io.Reader) (*deltaReader, error) {
+	dr, err := readDeltaHeader(r)
+	if err != nil && (err == io.ErrUnexpectedEOF || errors.Is(err, ErrCorruptDelta)) {
+		return nil, &CorruptDeltaError{Index: -1, Err: err}
+	}
+	return dr, err
+}
+
+func readDeltaHeader(r io.Reader) (*deltaReader, error) {
+	var b [4 + 1 + 4 + 1 + 8]byte
+	n, err := io.ReadFull(r, b[:4])
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	if n == 4 && byteOrder.Uint32(b[:4]) == rdiffDeltaMagic {
+		return &deltaReader{
+			Reader: r,
+			header: DeltaHeader{Format: Rdiff, Length: UnknownLength},
+			offset: 4,
+		}, nil
+	}
+
+	if byteOrder.Uint32(b[:4]) != deltaMagic {
+		// legacy: put back what has been read
+		return &deltaReader{
+			Reader: io.MultiReader(bytes.NewReader(b[:n]), r),
+			header: DeltaHeader{Length: UnknownLength},
+		}, nil
+	}
+
+	if _, err = io.ReadFull(r, b[4:]); err != nil {
+		return nil, noEOF(err)
+	}
+	header := DeltaHeader{
+		// version
+		Version: b[4],
+		// block size
+		BlockSize: byteOrder.Uint32(b[5:9]),
+		// strong hash
+		StrongHash: StrongHash(b[9]),
+		// length
+		Length: byteOrder.Uint64(b[10:]),
+	}
+	if header.Version != deltaVersion {
+		return nil, fmt.Errorf("%w: unsupported version: %d", ErrCorruptDelta, header.Version)
+	}
+	if !header.StrongHash.Available() {
+		return nil, fmt.Errorf("%w: unsupported strong hash: %v", ErrCorruptDelta, header.StrongHash)
+	}
+	offset := int64(len(b))
+	// basis digest
+	if header.BasisDigest, err = readDigest(r); err != nil {
+		return nil, err
+	}
+	offset += 1 + int64(len(header.BasisDigest))
+	// encoding & compression
+	if _, err = io.ReadFull(r, b[:2]); err != nil {
+		return nil, noEOF(err)
+	}
+	header.Encoding = DeltaEncoding(b[0])
+	header.Compression = Compression(b[1])
+	offset += 2
+
+	switch header.Compression {
+	case NoCompression:
+	case FlateCompression:
+		r = flate.NewReader(r)
+	default:
+		return nil, fmt.Errorf("%w: unsupported compression: %d", ErrCorruptDelta, header.Compression)
+	}
+
+	switch header.Encoding {
+	case FixedEncoding:
+	case CompactEncoding:
+		// varints are read byte by byte
+		if _, ok := r.(io.ByteReader); !ok {
+			r = bufio.NewReader(r)
+		}
+	default:
+		return nil, fmt.Errorf("%w: unsupported encoding: %d", ErrCorruptDelta, header.Encoding)
+	}
+	return &deltaReader{Reader: r, header: header, offset: offset}, nil
+}
+
+func (dr *deltaReader) Read(p []byte) (int, error) {
+	n, err := dr.Reader.Read(p)
+	dr.offset += int64(n)
+	if err != nil {
+		dr.err = err
+	}
+	return n, err
+}
+
+// ReadByte reads compact instructions, the underlying reader is an io.ByteReader then.
+func (dr *deltaReader) ReadByte() (byte, error) {
+	b, err := dr.Reader.(io.ByteReader).ReadByte()
+	if err != nil {
+		dr.err = err
+		return b, err
+	}
+	dr.offset++
+	return b, nil
+}
+
+// corrupt returns err as a CorruptDeltaError of the last instruction,
+// unless it is an error of the underlying reader (other than a truncated or corrupt compressed stream).
+func (dr *deltaReader) corrupt(err error, index int) error {
+	var flateErr flate.CorruptInputError
+	if err == dr.err && err != io.EOF && err != io.ErrUnexpectedEOF && !errors.As(err, &flateErr) {
+		return err
+	}
+	return &CorruptDeltaError{Offset: dr.start, Index: index, Err: noEOF(err)}
+}
+
+// copyData copies size bytes of literal data (of the last instruction) out to w, through buf unless it is nil.
+func (dr *deltaReader) copyData(w io.Writer, size uint64, buf []byte) error {
+	_, err := copyN(w, dr, int64(min(size, math.MaxInt64)), buf)
+	var flateErr flate.CorruptInputError
+	if err == io.EOF || err == io.ErrUnexpectedEOF || errors.As(err, &flateErr) {
+		// the delta ended (or is corrupt) within the data
+		return dr.corrupt(err, dr.index-1)
+	}
+	return err
+}
+
+// next reads the next instruction header.
+// It returns io.EOF at the end of the delta, once the trailer has been verified.
+func (dr *deltaReader) next() (i DeltaInstructionHeader, err error) {
+	dr.start = dr.offset
+	switch {
+	case dr.header.Format == Rdiff:
+		i, err = readRdiffCommand(dr)
+	case dr.header.Encoding == CompactEncoding:
+		i, err = readCompactInstruction(dr, &dr.copyEnd)
+	default:
+		i, err = ReadDeltaInstructionHeader(dr)
+	}
+	if err != nil {
+		if err == io.EOF && dr.header.legacy() {
+			return i, err
+		}
+		// versioned (and librsync) deltas must end with the trailer
+		return i, dr.corrupt(err, dr.index)
+	}
+	if i, err = dr.instruction(i); err != nil && err != io.EOF {
+		return i, dr.corrupt(err, dr.index)
+	}
+	dr.index++
+	return i, err
+}
+
+// instruction checks the instruction, and the trailer.
+func (dr *deltaReader) instruction(i DeltaInstructionHeader) (DeltaInstructionHeader, error) {
+	var err error
+
+	if i.From == FromEnd && dr.header.Format == Rdiff {
+		return i, io.EOF
+	}
+	if i.From == FromEnd {
+		if dr.header.legacy() {
+			return i, errors.New("unexpected delta trailer")
+		}
+		if i.Size != dr.length || (dr.header.Length != UnknownLength && i.Size != dr.header.Length) {
+			return i, fmt.Errorf("delta length mismatch: expected %d, got %d", i.Size, dr.length)
+		}
+		if dr.digest, err = readDigest(dr); err != nil {
+			return i, err
+		}
+		if dr.header.Compression != NoCompression {
+			// the compressed stream has to end right after the trailer
+			var b [1]byte
+			if n, err := io.ReadFull(dr, b[:]); n > 0 {
+				return i, errors.New("unexpected data after delta trailer")
+			} else if err != io.EOF {
+				return i, err
+			}
+		}
+		return i, io.EOF
+	}
+
+	dr.length += i.Size
+	return i, nil
+}
+
+// legacy reports whether the delta is in the legacy (headerless) format.
+func (header DeltaHeader) legacy() bool {
+	return header.Format == Native && header.Version == 0
+}
+
+func (w nativeWriter) writeInstruction(i *DeltaInstruction) error {
+	return i.writeTo(w)
+}
+
+func (w nativeWriter) writeEnd(length uint64) error {
+	trailer := DeltaInstruction{DeltaInstructionHeader: DeltaInstructionHeader{From: FromEnd, Size: length}}
+	return trailer.writeTo(w)
+}
+
+// readerLength returns the number of bytes left in r, if r can tell it cheaply.
+func readerLength(r io.Reader) uint64 {
+	switch v := r.(type) {
+	case interface{ Len() int }:
+		return uint64(v.Len())
+	case *os.File:
+		info, err := v.Stat()
+		if err != nil || !info.Mode().IsRegular() {
+			return UnknownLength
+		}
+		pos, err := v.Seek(0, io.SeekCurrent)
+		if err != nil || pos > info.Size() {
+			return UnknownLength
+		}
+		return uint64(info.Size() - pos)
+	}
+	return UnknownLength
+}
+
+func (i *DeltaInstruction) append(w instructionWriter, next *DeltaInstruction) error {
 	if next == nil || next.Size == 0 {
 		return nil
 	}
 
 	if i.From != next.From {
-		if err := i.writeTo(w); err != nil {
+		if err := i.flush(w); err != nil {
 			return err
 		}
 
 		i.From = next.From
 		i.Offset = next.Offset
 		i.Size = next.Size
-		i.Data = next.Data
+		// the data is copied, so next (and the pending data, once written out) can be reused
+		i.Data = append(i.Data[:0], next.Data...)
 
 		return nil
 	}
 
 	if i.From == FromNew {
+		if i.Size >= maxLiteralSize {
+			if err := i.flush(w); err != nil {
+				return err
+			}
+			i.Size, i.Data = 0, i.Data[:0]
+		}
 		i.Data = append(i.Data, next.Data...)
-		i.Size++
+		i.Size += next.Size
 	} else if i.From == FromOld {
 		if i.Offset+i.Size == next.Offset {
 			// merge blocks
 			i.Size += next.Size
 		} else {
-			if err := i.writeTo(w); err != nil {
+			if err := i.flush(w); err != nil {
 				return err
 			}
 
@@ -157,15 +606,19 @@ func (i *DeltaInstruction) append(w io.Writer, next *DeltaInstruction) error {
 	return nil
 }
 
-func (i *DeltaInstruction) writeTo(w io.Writer) error {
+// flush writes the (pending) instruction out to w, unless it is empty.
+func (i *DeltaInstruction) flush(w instructionWriter) error {
 	if i.Size == 0 {
 		return nil
 	}
+	return w.writeInstruction(i)
+}
 
+func (i *DeltaInstruction) writeTo(w io.Writer) error {
 	var b [1 + 8 + 8]byte
 	b[0] = i.From
-	ByteOrder.PutUint64(b[1:9], i.Offset)
-	ByteOrder.PutUint64(b[9:], i.Size)
+	byteOrder.PutUint64(b[1:9], i.Offset)
+	byteOrder.PutUint64(b[9:], i.Size)
 	if _, err := w.Write(b[:]); err != nil {
 		return err
 	}
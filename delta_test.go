@@ -2,7 +2,12 @@ package diff
 
 import (
 	"bytes"
+	"io"
+	"math/rand"
+	"strings"
 	"testing"
+	"testing/iotest"
+	"testing/quick"
 
 	"github.com/stretchr/testify/require"
 )
@@ -19,7 +24,7 @@ func TestDeltaAdd(t *testing.T) {
 	)
 	delta := []*DeltaInstruction{
 		{DeltaInstructionHeader: DeltaInstructionHeader{From: FromNew, Offset: 0, Size: uint64(blockSize)}},
-		{DeltaInstructionHeader: DeltaInstructionHeader{From: FromOld, Offset: 0, Size: uint64(44)}},
+		{DeltaInstructionHeader: DeltaInstructionHeader{From: FromOld, Offset: 0, Size: uint64(len(oldText))}},
 	}
 
 	oldReader := bytes.NewBufferString(oldText)
@@ -58,7 +63,7 @@ func TestDeltaShift(t *testing.T) {
 		{DeltaInstructionHeader: DeltaInstructionHeader{From: FromOld, Offset: 11, Size: uint64(blockSize)}},
 		{DeltaInstructionHeader: DeltaInstructionHeader{From: FromOld, Offset: 0, Size: uint64(blockSize)}},
 		{DeltaInstructionHeader: DeltaInstructionHeader{From: FromNew, Offset: 0, Size: uint64(1)}},
-		{DeltaInstructionHeader: DeltaInstructionHeader{From: FromOld, Offset: 22, Size: uint64(blockSize + blockSize)}},
+		{DeltaInstructionHeader: DeltaInstructionHeader{From: FromOld, Offset: 22, Size: uint64(len(oldText) - 22)}},
 	}
 
 	oldReader := bytes.NewBufferString(oldText)
@@ -97,7 +102,7 @@ func TestDeltaDelete(t *testing.T) {
 	delta := []*DeltaInstruction{
 		{DeltaInstructionHeader: DeltaInstructionHeader{From: FromNew, Offset: 0, Size: uint64(blockSize)}},
 		{DeltaInstructionHeader: DeltaInstructionHeader{From: FromOld, Offset: 0, Size: uint64(blockSize)}},
-		{DeltaInstructionHeader: DeltaInstructionHeader{From: FromOld, Offset: 33, Size: uint64(blockSize)}},
+		{DeltaInstructionHeader: DeltaInstructionHeader{From: FromOld, Offset: 33, Size: uint64(len(oldText) - 33)}},
 	}
 
 	oldReader := bytes.NewBufferString(oldText)
@@ -135,7 +140,7 @@ func TestDeltaAddShiftDelete(t *testing.T) {
 	delta := []*DeltaInstruction{
 		{DeltaInstructionHeader: DeltaInstructionHeader{From: FromNew, Offset: 0, Size: uint64(blockSize)}},
 		{DeltaInstructionHeader: DeltaInstructionHeader{From: FromOld, Offset: 0, Size: uint64(blockSize + blockSize)}},
-		{DeltaInstructionHeader: DeltaInstructionHeader{From: FromOld, Offset: 44, Size: uint64(blockSize)}},
+		{DeltaInstructionHeader: DeltaInstructionHeader{From: FromOld, Offset: 44, Size: uint64(len(oldText) - 44)}},
 	}
 
 	oldReader := bytes.NewBufferString(oldText)
@@ -197,3 +202,457 @@ func TestDeltaOneByte(t *testing.T) {
 		require.EqualValues(delta[i].DeltaInstructionHeader, in.DeltaInstructionHeader)
 	}
 }
+
+func TestDeltaHeader(t *testing.T) {
+	require := require.New(t)
+
+	buf := bytes.NewBuffer(nil)
+	header := DeltaHeader{
+		Version:    deltaVersion,
+		BlockSize:  4096,
+		StrongHash: MD5,
+		Length:     1 << 40,
+	}
+
+	err := writeDeltaHeader(buf, header)
+	require.NoError(err)
+
+	dr, err := newDeltaReader(buf)
+	require.NoError(err)
+	require.Equal(header, dr.header)
+
+	for _, version := range []byte{0, deltaVersion + 1} {
+		buf.Reset()
+		header.Version = version
+		require.NoError(writeDeltaHeader(buf, header))
+		_, err = newDeltaReader(buf)
+		require.ErrorIs(err, ErrCorruptDelta, "version %d", version)
+	}
+}
+
+func TestDeltaLegacy(t *testing.T) {
+	require := require.New(t)
+
+	buf := bytes.NewBuffer(nil)
+	delta := []*DeltaInstruction{
+		{DeltaInstructionHeader: DeltaInstructionHeader{From: FromNew, Offset: 0, Size: 3}, Data: []byte("abc")},
+		{DeltaInstructionHeader: DeltaInstructionHeader{From: FromOld, Offset: 11, Size: 22}},
+	}
+	for _, i := range delta {
+		require.NoError(i.writeTo(buf))
+	}
+
+	instr, err := ReadDelta(buf)
+	require.NoError(err)
+	require.EqualValues(delta, instr)
+
+	instr, err = ReadDelta(bytes.NewBuffer(nil))
+	require.NoError(err)
+	require.Empty(instr)
+}
+
+func TestDeltaTruncated(t *testing.T) {
+	require := require.New(t)
+
+	const (
+		strongSize = byte(4)
+		blockSize  = uint32(11)
+
+		oldText = `ala ma kota,kot ma ale,lal al ala,tyl e`
+		newText = `toj es tto,ala ma kota,kot ma ale,lal al ala,tyl e`
+	)
+
+	sig, err := WriteSignature(bytes.NewBufferString(oldText), bytes.NewBuffer(nil), blockSize, strongSize)
+	require.NoError(err)
+
+	deltaBuffer := bytes.NewBuffer(nil)
+	err = WriteDelta(sig, bytes.NewBufferString(newText), deltaBuffer)
+	require.NoError(err)
+
+	b := deltaBuffer.Bytes()
+	for n := len(b) - 1; n > 0; n-- {
+		_, err = ReadDelta(bytes.NewBuffer(b[:n]))
+		require.Errorf(err, "truncated at %d", n)
+	}
+}
+
+func TestDeltaForeign(t *testing.T) {
+	require := require.New(t)
+
+	sigBuffer := bytes.NewBuffer(nil)
+	_, err := WriteSignature(bytes.NewBufferString(`ala ma kota,kot ma ale`), sigBuffer, 4, 4)
+	require.NoError(err)
+
+	_, err = ReadDelta(sigBuffer)
+	require.Error(err)
+
+	_, err = ReadDeltaInstructionHeader(bytes.NewBufferString(`lorem ipsum dolor sit amet`))
+	require.Error(err)
+}
+
+func TestDeltaWeakCollision(t *testing.T) {
+	require := require.New(t)
+
+	const (
+		strongSize = byte(4)
+		blockSize  = uint32(4)
+
+		// "baab" and "abba" share the weak checksum
+		oldText = `baababba`
+		newText = `abbaXbaab`
+	)
+	delta := []*DeltaInstruction{
+		{DeltaInstructionHeader: DeltaInstructionHeader{From: FromOld, Offset: 4, Size: uint64(blockSize)}},
+		{DeltaInstructionHeader: DeltaInstructionHeader{From: FromNew, Offset: 0, Size: 1}},
+		{DeltaInstructionHeader: DeltaInstructionHeader{From: FromOld, Offset: 0, Size: uint64(blockSize)}},
+	}
+
+	sig, err := WriteSignature(bytes.NewBufferString(oldText), bytes.NewBuffer(nil), blockSize, strongSize)
+	require.NoError(err)
+
+	deltaBuffer := bytes.NewBuffer(nil)
+	err = WriteDelta(sig, bytes.NewBufferString(newText), deltaBuffer)
+	require.NoError(err)
+
+	instr, err := ReadDelta(deltaBuffer)
+	require.NoError(err)
+	require.Len(instr, len(delta))
+
+	for i, in := range instr {
+		require.EqualValues(delta[i].DeltaInstructionHeader, in.DeltaInstructionHeader)
+	}
+}
+
+func TestDeltaRepeatedBlocks(t *testing.T) {
+	require := require.New(t)
+
+	const (
+		strongSize = byte(4)
+		blockSize  = uint32(16)
+	)
+	// zero-filled basis, every block shares the weak and the strong checksum
+	oldText := make([]byte, 64*blockSize)
+	newText := append([]byte(`header`), oldText...)
+
+	sig, err := WriteSignature(bytes.NewBuffer(oldText), bytes.NewBuffer(nil), blockSize, strongSize)
+	require.NoError(err)
+
+	deltaBuffer := bytes.NewBuffer(nil)
+	err = WriteDelta(sig, bytes.NewBuffer(newText), deltaBuffer)
+	require.NoError(err)
+
+	instr, err := ReadDelta(deltaBuffer)
+	require.NoError(err)
+	require.Len(instr, 2)
+	require.EqualValues(DeltaInstructionHeader{From: FromNew, Offset: 0, Size: 6}, instr[0].DeltaInstructionHeader)
+	require.EqualValues(DeltaInstructionHeader{From: FromOld, Offset: 0, Size: uint64(len(oldText))}, instr[1].DeltaInstructionHeader)
+}
+
+func TestDeltaCompressed(t *testing.T) {
+	require := require.New(t)
+
+	const (
+		strongSize = byte(8)
+		blockSize  = uint32(64)
+	)
+	oldText := strings.Repeat("2024-01-01 00:00:00 INFO request served in 10ms\n", 100)
+	newText := strings.Repeat("2024-01-02 00:00:00 WARN request served in 99ms\n", 50) + oldText
+
+	sig, err := WriteSignature(strings.NewReader(oldText), bytes.NewBuffer(nil), blockSize, strongSize)
+	require.NoError(err)
+
+	for _, encoding := range []DeltaEncoding{FixedEncoding, CompactEncoding} {
+		plain := bytes.NewBuffer(nil)
+		err = DeltaOptions{Encoding: encoding, Compression: NoCompression}.WriteDelta(sig, strings.NewReader(newText), plain)
+		require.NoError(err)
+
+		compressed := bytes.NewBuffer(nil)
+		err = DeltaOptions{Encoding: encoding, Compression: FlateCompression}.WriteDelta(sig, strings.NewReader(newText), compressed)
+		require.NoError(err)
+		require.Less(compressed.Len(), plain.Len()/4)
+
+		header, err := ReadDeltaHeader(bytes.NewReader(compressed.Bytes()))
+		require.NoError(err)
+		require.Equal(FlateCompression, header.Compression)
+		require.Equal(encoding, header.Encoding)
+
+		d1, err := ReadDelta(bytes.NewReader(plain.Bytes()))
+		require.NoError(err)
+		d2, err := ReadDelta(bytes.NewReader(compressed.Bytes()))
+		require.NoError(err)
+		require.EqualValues(d1, d2)
+
+		buf := bytes.NewBuffer(nil)
+		err = Patch(strings.NewReader(oldText), bytes.NewReader(compressed.Bytes()), buf)
+		require.NoError(err)
+		require.Equal(newText, buf.String())
+
+		b := compressed.Bytes()
+		for n := len(b) - 1; n > 0; n-- {
+			_, err = ReadDelta(bytes.NewReader(b[:n]))
+			require.Errorf(err, "truncated at %d", n)
+		}
+	}
+
+	err = DeltaOptions{Encoding: FixedEncoding, Compression: Compression(0xff)}.WriteDelta(sig, strings.NewReader(newText), bytes.NewBuffer(nil))
+	require.Error(err)
+}
+
+func TestDeltaOptions(t *testing.T) {
+	require := require.New(t)
+
+	oldText := strings.Repeat("2024-01-01 00:00:00 INFO request served in 10ms\n", 10)
+	newText := "2024-01-02 00:00:00 WARN request served in 99ms\n" + oldText
+
+	sig, err := WriteSignature(strings.NewReader(oldText), bytes.NewBuffer(nil), 16, 8)
+	require.NoError(err)
+
+	expected := bytes.NewBuffer(nil)
+	err = DeltaOptions{Encoding: CompactEncoding, Compression: FlateCompression}.WriteDelta(sig, strings.NewReader(newText), expected)
+	require.NoError(err)
+
+	opts := DeltaOptions{Encoding: CompactEncoding, Compression: FlateCompression}
+	for _, bufferSize := range []int{0, 1, 17, 4096} {
+		opts.BufferSize = bufferSize
+		delta := bytes.NewBuffer(nil)
+		err = opts.WriteDelta(sig, strings.NewReader(newText), delta)
+		require.NoError(err)
+		require.Equal(expected.Bytes(), delta.Bytes())
+	}
+
+	expected.Reset()
+	err = DeltaOptions{Format: Rdiff}.WriteDelta(sig, strings.NewReader(newText), expected)
+	require.NoError(err)
+
+	delta := bytes.NewBuffer(nil)
+	err = DeltaOptions{Format: Rdiff}.WriteDelta(sig, strings.NewReader(newText), delta)
+	require.NoError(err)
+	require.Equal(expected.Bytes(), delta.Bytes())
+
+	err = DeltaOptions{Format: Rdiff, Encoding: CompactEncoding}.WriteDelta(sig, strings.NewReader(newText), bytes.NewBuffer(nil))
+	require.Error(err)
+	err = DeltaOptions{Format: Rdiff, Compression: FlateCompression}.WriteDelta(sig, strings.NewReader(newText), bytes.NewBuffer(nil))
+	require.Error(err)
+	err = DeltaOptions{Format: Format(0xff)}.WriteDelta(sig, strings.NewReader(newText), bytes.NewBuffer(nil))
+	require.Error(err)
+}
+
+func TestDeltaInOrder(t *testing.T) {
+	require := require.New(t)
+
+	const (
+		strongSize = byte(8)
+		blockSize  = uint32(8)
+	)
+	oldText := `aaaaaaaabbbbbbbbccccccccddddddddeeeeeeee`
+	// blocks moved backwards, and a repeated block
+	newText := `ccccccccddddddddaaaaaaaabbbbbbbbeeeeeeeexeeeeeeee`
+
+	sig, err := WriteSignature(strings.NewReader(oldText), bytes.NewBuffer(nil), blockSize, strongSize)
+	require.NoError(err)
+
+	delta := bytes.NewBuffer(nil)
+	err = DeltaOptions{}.WriteDelta(sig, strings.NewReader(newText), delta)
+	require.NoError(err)
+	instr, err := ReadDelta(delta)
+	require.NoError(err)
+	require.EqualValues(DeltaInstructionHeader{From: FromOld, Offset: 16, Size: 16}, instr[0].DeltaInstructionHeader)
+	require.EqualValues(DeltaInstructionHeader{From: FromOld, Offset: 0, Size: 16}, instr[1].DeltaInstructionHeader)
+
+	for _, format := range []Format{Native, Rdiff} {
+		delta = bytes.NewBuffer(nil)
+		err = DeltaOptions{Format: format, InOrder: true}.WriteDelta(sig, strings.NewReader(newText), delta)
+		require.NoError(err)
+
+		instr, err = ReadDelta(bytes.NewReader(delta.Bytes()))
+		require.NoError(err)
+		require.EqualValues(DeltaInstructionHeader{From: FromOld, Offset: 16, Size: 16}, instr[0].DeltaInstructionHeader)
+		require.EqualValues(DeltaInstructionHeader{From: FromNew, Offset: 0, Size: 16}, instr[1].DeltaInstructionHeader)
+		copyEnd := uint64(0)
+		for _, i := range instr {
+			if i.From == FromOld {
+				require.GreaterOrEqual(i.Offset, copyEnd)
+				copyEnd = i.Offset + i.Size
+			}
+		}
+
+		buf := bytes.NewBuffer(nil)
+		err = PatchStream(strings.NewReader(oldText), bytes.NewReader(delta.Bytes()), buf)
+		require.NoError(err)
+		require.Equal(newText, buf.String())
+	}
+}
+
+func TestDeltaFinalBlock(t *testing.T) {
+	require := require.New(t)
+
+	const blockSize = 8
+	// the basis ends with a short block ("tail"), the new file changes everything before it
+	oldText := `aaaaaaaabbbbbbbbtail`
+	newText := `xxxxxxxxxxxxxxxxxxxxxtail`
+
+	for _, format := range []Format{Native, Rdiff} {
+		sig, err := SignatureOptions{Format: format, BlockSize: blockSize, StrongSize: 8, StrongHash: MD4}.WriteSignature(strings.NewReader(oldText), bytes.NewBuffer(nil))
+		require.NoError(err)
+
+		delta := bytes.NewBuffer(nil)
+		require.NoError(DeltaOptions{Format: format}.WriteDelta(sig, strings.NewReader(newText), delta))
+		instr, err := ReadDelta(bytes.NewReader(delta.Bytes()))
+		require.NoError(err)
+
+		last := instr[len(instr)-1].DeltaInstructionHeader
+		if format == Native {
+			require.EqualValues(DeltaInstructionHeader{From: FromOld, Offset: 16, Size: 4}, last)
+		} else {
+			// librsync signatures do not record the basis length
+			require.EqualValues(FromNew, last.From)
+		}
+
+		buf := bytes.NewBuffer(nil)
+		require.NoError(Patch(strings.NewReader(oldText), bytes.NewReader(delta.Bytes()), buf))
+		require.Equal(newText, buf.String())
+	}
+}
+
+func TestDeltaProperties(t *testing.T) {
+	// The delta of any new file recreates it, and a new file ending with the basis' final (short) block
+	// reuses it, with basis lengths which are not multiples of the block size.
+	property := func(seed int64, blockSize uint8, inOrder bool) bool {
+		rnd := rand.New(rand.NewSource(seed))
+		bs := 1 + int(blockSize)%64
+
+		basis := make([]byte, rnd.Intn(20*bs))
+		rnd.Read(basis)
+		// at least a byte, so there is an instruction
+		newData := []byte{byte(rnd.Intn(4))}
+		for len(newData) < len(basis) {
+			if rnd.Intn(2) == 0 && len(basis) > 0 {
+				from := rnd.Intn(len(basis))
+				newData = append(newData, basis[from:from+rnd.Intn(len(basis)-from+1)]...)
+			} else {
+				newData = append(newData, byte(rnd.Intn(4)))
+			}
+		}
+		tail := len(basis) % bs
+		newData = append(newData, basis[len(basis)-tail:]...)
+
+		sig, err := SignatureOptions{BlockSize: uint32(bs), StrongSize: 16}.WriteSignature(bytes.NewReader(basis), bytes.NewBuffer(nil))
+		if err != nil {
+			t.Log(err)
+			return false
+		}
+		delta := bytes.NewBuffer(nil)
+		if err = (DeltaOptions{InOrder: inOrder}).WriteDelta(sig, bytes.NewReader(newData), delta); err != nil {
+			t.Log(err)
+			return false
+		}
+
+		instr, err := ReadDelta(bytes.NewReader(delta.Bytes()))
+		if err != nil {
+			t.Log(err)
+			return false
+		}
+		if last := instr[len(instr)-1]; tail > 0 && last.From == FromNew && last.Size >= uint64(tail) {
+			// the tail is literal data, which is only allowed if (in order) a copy went past the final block
+			copyEnd := uint64(0)
+			for _, i := range instr {
+				if i.From == FromOld {
+					copyEnd = i.Offset + i.Size
+				}
+			}
+			if !inOrder || copyEnd <= uint64(len(basis)-tail) {
+				t.Logf("final block not matched: %v", last.DeltaInstructionHeader)
+				return false
+			}
+		}
+
+		buf := bytes.NewBuffer(nil)
+		if err = Patch(bytes.NewReader(basis), bytes.NewReader(delta.Bytes()), buf); err != nil {
+			t.Log(err)
+			return false
+		}
+		return bytes.Equal(newData, buf.Bytes())
+	}
+
+	require.NoError(t, quick.Check(property, &quick.Config{MaxCount: 500}))
+}
+
+func TestDeltaShortReads(t *testing.T) {
+	require := require.New(t)
+
+	basis := bytes.Repeat([]byte(`ala ma kota,kot ma ale,`), 50)
+	newData := append([]byte(`toj es tto,`), basis[100:]...)
+	newData = append(newData, `lal al ala,tyl e`...)
+
+	for _, opts := range []DeltaOptions{
+		{},
+		{Encoding: CompactEncoding},
+		{Encoding: CompactEncoding, Compression: FlateCompression},
+		{Format: Rdiff},
+	} {
+		sigOpts := SignatureOptions{Format: opts.Format, BlockSize: 16, StrongSize: 8, StrongHash: MD4}
+		sig, err := sigOpts.WriteSignature(bytes.NewReader(basis), io.Discard)
+		require.NoError(err)
+		buf := bytes.NewBuffer(nil)
+		require.NoError(opts.WriteDelta(sig, bytes.NewReader(newData), buf))
+		b := buf.Bytes()
+
+		expected, err := ReadDelta(bytes.NewReader(b))
+		require.NoError(err)
+		header, err := ReadDeltaHeader(bytes.NewReader(b))
+		require.NoError(err)
+		for name, r := range shortReaders(b) {
+			delta, err := ReadDelta(r)
+			require.NoError(err, name)
+			require.Equal(expected, delta, name)
+		}
+		for name, r := range shortReaders(b) {
+			h, err := ReadDeltaHeader(r)
+			require.NoError(err, name)
+			require.Equal(header, h, name)
+		}
+		for name, r := range shortReaders(b) {
+			out := bytes.NewBuffer(nil)
+			require.NoError(Patch(bytes.NewReader(basis), r, out), name)
+			require.Equal(newData, out.Bytes(), name)
+		}
+
+		// truncated records
+		for n := 1; n < len(b); n++ {
+			_, err = ReadDelta(iotest.OneByteReader(bytes.NewReader(b[:n])))
+			require.ErrorIs(err, io.ErrUnexpectedEOF, "truncated at %d", n)
+			err = Patch(bytes.NewReader(basis), iotest.HalfReader(bytes.NewReader(b[:n])), io.Discard)
+			require.ErrorIs(err, io.ErrUnexpectedEOF, "truncated at %d", n)
+		}
+	}
+}
+
+func TestDeltaInstructionHeaderShortReads(t *testing.T) {
+	require := require.New(t)
+
+	i := DeltaInstruction{DeltaInstructionHeader: DeltaInstructionHeader{From: FromOld, Offset: 1 << 40, Size: 12345}}
+	buf := bytes.NewBuffer(nil)
+	require.NoError(i.writeTo(buf))
+	b := buf.Bytes()
+
+	for name, r := range shortReaders(b) {
+		header, err := ReadDeltaInstructionHeader(r)
+		require.NoError(err, name)
+		require.Equal(i.DeltaInstructionHeader, header, name)
+	}
+
+	_, err := ReadDeltaInstructionHeader(bytes.NewReader(nil))
+	require.Equal(io.EOF, err)
+	for n := 1; n < len(b); n++ {
+		_, err = ReadDeltaInstructionHeader(iotest.OneByteReader(bytes.NewReader(b[:n])))
+		require.ErrorIs(err, io.ErrUnexpectedEOF, "truncated at %d", n)
+	}
+
+	// a literal larger than the delta is not allocated up front
+	buf.Reset()
+	require.NoError(writeDeltaHeader(buf, DeltaHeader{Version: deltaVersion, Length: UnknownLength}))
+	i = DeltaInstruction{DeltaInstructionHeader: DeltaInstructionHeader{From: FromNew, Size: 1 << 60}, Data: []byte(`literal`)}
+	require.NoError(i.writeTo(buf))
+	_, err = ReadDelta(buf)
+	require.ErrorIs(err, io.ErrUnexpectedEOF)
+}
@@ -3,9 +3,106 @@ package diff
 import (
 	"crypto/md5"
 	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
 )
 
 var (
+	// ByteOrder was the byte order of the native formats.
+	//
+	// Deprecated: the native formats are always big-endian, ByteOrder is ignored. This breaks no legacy files:
+	// ByteOrder has the type of binary.BigEndian, so it could never be set to another byte order.
 	ByteOrder = binary.BigEndian
-	NewHash   = md5.New
+
+	// NewHash returns the hash of legacy signatures, which do not record their strong hash.
+	//
+	// Deprecated: use SignatureOptions.StrongHash. NewHash is only consulted when reading legacy signatures.
+	NewHash = md5.New
+)
+
+// DiffOptions configures the signature and the delta written by Diff.
+type DiffOptions struct {
+	// Signature configures the signature of the basis, which is never written out (so its Format is ignored).
+	Signature SignatureOptions
+	Delta     DeltaOptions
+}
+
+// Diff writes the delta between basisReader and newReader out to deltaWriter in a single step:
+// the signature of the basis is generated in memory (see SignatureOptions.NewSignature), and the delta is written as newReader is read.
+// A newReader which is an io.ReaderAt and an io.Seeker of known length (e.g. an *os.File or a *bytes.Reader) is scanned
+// from its current offset with DeltaOptions.WriteDeltaAt instead, concurrently; it is not advanced then.
+func Diff(basisReader io.Reader, newReader io.Reader, deltaWriter io.Writer, opts DiffOptions) error {
+	signature, err := opts.Signature.NewSignature(basisReader)
+	if err != nil {
+		return err
+	}
+	if newReaderAt, newLength, ok := sectionReader(newReader); ok {
+		return opts.Delta.WriteDeltaAt(signature, newReaderAt, newLength, deltaWriter)
+	}
+	return opts.Delta.WriteDelta(signature, newReader, deltaWriter)
+}
+
+// sectionReader returns the rest of r (from its current offset) as an io.ReaderAt, if r is one of known length.
+func sectionReader(r io.Reader) (*io.SectionReader, int64, bool) {
+	ra, ok := r.(io.ReaderAt)
+	seeker, seekable := r.(io.Seeker)
+	length := readerLength(r)
+	if !ok || !seekable || length == UnknownLength || length > math.MaxInt64 {
+		return nil, 0, false
+	}
+	offset, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, 0, false
+	}
+	return io.NewSectionReader(ra, offset, int64(length)), int64(length), true
+}
+
+// byteOrder is the (fixed) byte order of the native formats.
+var byteOrder = binary.BigEndian
+
+// Format is the wire format of a signature or a delta.
+type Format byte
+
+const (
+	// Native is the format of this package.
+	Native = Format(0x0)
+	// Rdiff is the librsync (rdiff) format.
+	Rdiff = Format(0x1)
 )
+
+// writeDigest writes a whole-file digest as {size: 1 byte, digest: size bytes}.
+func writeDigest(w io.Writer, digest []byte) error {
+	if _, err := w.Write([]byte{byte(len(digest))}); err != nil {
+		return err
+	}
+	_, err := w.Write(digest)
+	return err
+}
+
+// readDigest reads a whole-file digest written by writeDigest, an empty digest is returned as nil.
+func readDigest(r io.Reader) ([]byte, error) {
+	var size [1]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, noEOF(err)
+	}
+	if size[0] == 0 {
+		return nil, nil
+	}
+
+	digest := make([]byte, size[0])
+	if _, err := io.ReadFull(r, digest); err != nil {
+		return nil, noEOF(err)
+	}
+	return digest, nil
+}
+
+func (f Format) String() string {
+	switch f {
+	case Native:
+		return "native"
+	case Rdiff:
+		return "rdiff"
+	}
+	return fmt.Sprintf("Format(%d)", byte(f))
+}
@@ -0,0 +1,66 @@
+package diff
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiff(t *testing.T) {
+	require := require.New(t)
+
+	rnd := rand.New(rand.NewSource(1))
+	basis := make([]byte, 100000)
+	rnd.Read(basis)
+	newData := append([]byte(`toj es tto,`), basis[:50000]...)
+	newData = append(newData, basis[60000:99999]...)
+
+	for _, opts := range []DiffOptions{
+		{},
+		{Signature: SignatureOptions{BlockSize: 512, StrongSize: 8, WeakHash: RabinKarp, Workers: 4}},
+		{Delta: DeltaOptions{Encoding: CompactEncoding, Compression: FlateCompression, InOrder: true}},
+		{Signature: SignatureOptions{Format: Rdiff, StrongHash: BLAKE2b}, Delta: DeltaOptions{Format: Rdiff}},
+	} {
+		sig, err := opts.Signature.NewSignature(bytes.NewReader(basis))
+		require.NoError(err)
+		// the in-memory signature is a native one
+		sigOpts := opts.Signature
+		sigOpts.Format = Native
+		buf := bytes.NewBuffer(nil)
+		written, err := sigOpts.WriteSignature(bytes.NewReader(basis), buf)
+		require.NoError(err)
+		require.Equal(written, sig)
+		read, err := ReadSignature(buf)
+		require.NoError(err)
+		require.Equal(read, sig)
+
+		expected := bytes.NewBuffer(nil)
+		require.NoError(opts.Delta.WriteDelta(written, bytes.NewReader(newData), expected))
+		delta := bytes.NewBuffer(nil)
+		require.NoError(Diff(bytes.NewReader(basis), bytes.NewReader(newData), delta, opts))
+		require.Equal(expected.Bytes(), delta.Bytes())
+
+		out := bytes.NewBuffer(nil)
+		require.NoError(Patch(bytes.NewReader(basis), delta, out))
+		require.Equal(newData, out.Bytes())
+	}
+
+	// the new file is scanned from its current offset, concurrently or not
+	expected := bytes.NewBuffer(nil)
+	require.NoError(Diff(bytes.NewReader(basis), &lengthReader{iotest.OneByteReader(bytes.NewReader(newData[100:])), len(newData) - 100}, expected, DiffOptions{}))
+	r := bytes.NewReader(newData)
+	_, err := r.Seek(100, io.SeekStart)
+	require.NoError(err)
+	delta := bytes.NewBuffer(nil)
+	require.NoError(Diff(bytes.NewReader(basis), r, delta, DiffOptions{Delta: DeltaOptions{Workers: 4}}))
+	require.Equal(expected.Bytes(), delta.Bytes())
+
+	err = Diff(bytes.NewReader(basis), bytes.NewReader(newData), io.Discard, DiffOptions{Signature: SignatureOptions{StrongSize: 64}})
+	require.ErrorIs(err, ErrInvalidOptions)
+	err = Diff(bytes.NewReader(basis), bytes.NewReader(newData), io.Discard, DiffOptions{Delta: DeltaOptions{Encoding: DeltaEncoding(9)}})
+	require.ErrorIs(err, ErrInvalidOptions)
+}
@@ -0,0 +1,62 @@
+package diff
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Errors returned by the package can be told apart with errors.Is (and errors.As for a CorruptDeltaError).
+var (
+	// ErrChecksumMismatch is returned if a file does not match the digest recorded for it.
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+	// ErrOutOfOrder is returned by PatchStream if a copy offset goes backwards, see DeltaOptions.InOrder.
+	ErrOutOfOrder = errors.New("delta copies are out of order")
+	// ErrInvalidOptions is returned for unsupported or invalid signature and delta options (e.g. a zero block size).
+	ErrInvalidOptions = errors.New("invalid options")
+	// ErrInvalidSignature is returned by ReadSignature for truncated, corrupt or unsupported signatures.
+	ErrInvalidSignature = errors.New("invalid signature")
+	// ErrCorruptDelta matches every CorruptDeltaError.
+	ErrCorruptDelta = errors.New("corrupt delta")
+	// ErrBasisTooShort is returned if a delta copies past the end of the basis (or a basis ends before its given length).
+	// It wraps io.ErrUnexpectedEOF.
+	ErrBasisTooShort = fmt.Errorf("basis too short: %w", io.ErrUnexpectedEOF)
+	// ErrLengthChanged is returned while writing a signature or a delta if the basis or the new file does not have
+	// the length it was known to have (e.g. it was modified meanwhile). A file which is too short wraps io.ErrUnexpectedEOF as well.
+	ErrLengthChanged = errors.New("file length changed")
+)
+
+// CorruptDeltaError is returned for truncated, corrupt or unsupported deltas, by ReadDelta and while patching.
+type CorruptDeltaError struct {
+	// Offset is the offset in the delta of the header, instruction or trailer which is corrupt.
+	// The instructions of compressed deltas are counted in uncompressed bytes (after the header).
+	Offset int64
+	// Index is the index of the instruction (the trailer is counted as one), or -1 for the header.
+	Index int
+	// Err is the cause, e.g. io.ErrUnexpectedEOF for a truncated delta.
+	Err error
+}
+
+func (e *CorruptDeltaError) Error() string {
+	if e.Index < 0 {
+		return fmt.Sprintf("corrupt delta header: %v", e.Err)
+	}
+	return fmt.Sprintf("corrupt delta at offset %d (instruction %d): %v", e.Offset, e.Index, e.Err)
+}
+
+func (e *CorruptDeltaError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is ErrCorruptDelta.
+func (e *CorruptDeltaError) Is(target error) bool {
+	return target == ErrCorruptDelta
+}
+
+// noEOF turns io.EOF into io.ErrUnexpectedEOF, for records that were already partially read.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,183 @@
+package diff
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestErrorsSignature(t *testing.T) {
+	require := require.New(t)
+
+	basis := bytes.Repeat([]byte(`ala ma kota,kot ma ale,`), 10)
+	for _, format := range []Format{Native, Rdiff} {
+		buf := bytes.NewBuffer(nil)
+		_, err := SignatureOptions{Format: format, BlockSize: 16, StrongSize: 8, StrongHash: MD4}.WriteSignature(bytes.NewReader(basis), buf)
+		require.NoError(err)
+
+		b := buf.Bytes()
+		for n := 5; n < len(b); n++ {
+			if format == Rdiff && (n-12)%(4+8) == 0 {
+				// librsync signatures do not record the number of blocks
+				continue
+			}
+			_, err = ReadSignature(bytes.NewReader(b[:n]))
+			require.ErrorIs(err, ErrInvalidSignature, "%v truncated at %d", format, n)
+			require.ErrorIs(err, io.ErrUnexpectedEOF, "%v truncated at %d", format, n)
+		}
+	}
+
+	_, err := SignatureOptions{BlockSize: 16, StrongSize: 64, StrongHash: MD4}.WriteSignature(bytes.NewReader(basis), io.Discard)
+	require.ErrorIs(err, ErrInvalidOptions)
+	_, err = SignatureOptions{Format: Rdiff, BlockSize: 16, StrongSize: 8, StrongHash: SHA256}.WriteSignature(bytes.NewReader(basis), io.Discard)
+	require.ErrorIs(err, ErrInvalidOptions)
+
+	// deltas are not (legacy) signatures
+	sig, err := WriteSignature(bytes.NewReader(basis), io.Discard, 16, 8)
+	require.NoError(err)
+	for _, format := range []Format{Native, Rdiff} {
+		buf := bytes.NewBuffer(nil)
+		require.NoError(DeltaOptions{Format: format}.WriteDelta(sig, bytes.NewReader(basis), buf))
+		_, err = ReadSignature(bytes.NewReader(buf.Bytes()))
+		require.ErrorIs(err, ErrInvalidSignature, "%v", format)
+		_, err = OpenSignature(bytes.NewReader(buf.Bytes()))
+		require.ErrorIs(err, ErrInvalidSignature, "%v", format)
+	}
+
+	// legacy block sizes are bounded
+	_, err = ReadSignature(bytes.NewReader([]byte{0x10, 0x0, 0x0, 0x0, 0x8}))
+	require.ErrorIs(err, ErrInvalidSignature)
+}
+
+func TestErrorsDelta(t *testing.T) {
+	require := require.New(t)
+
+	basis := bytes.Repeat([]byte(`ala ma kota,kot ma ale,`), 10)
+	newData := append([]byte(`toj es tto,`), basis[20:]...)
+	newData = append(newData, `lal al ala,tyl e`...)
+
+	for _, opts := range []DeltaOptions{
+		{},
+		{Encoding: CompactEncoding},
+		{Encoding: CompactEncoding, Compression: FlateCompression},
+		{Format: Rdiff},
+	} {
+		sig, err := SignatureOptions{Format: opts.Format, BlockSize: 16, StrongSize: 8, StrongHash: MD4}.WriteSignature(bytes.NewReader(basis), io.Discard)
+		require.NoError(err)
+		buf := bytes.NewBuffer(nil)
+		require.NoError(opts.WriteDelta(sig, bytes.NewReader(newData), buf))
+		b := buf.Bytes()
+
+		// starts holds the offsets of the instructions (and the trailer), found by truncating the delta right before them
+		var starts []int64
+		index, offset := -1, int64(0)
+		for n := 1; n < len(b); n++ {
+			for _, err := range []error{
+				func() error { _, err := ReadDelta(bytes.NewReader(b[:n])); return err }(),
+				Patch(bytes.NewReader(basis), bytes.NewReader(b[:n]), io.Discard),
+			} {
+				var corrupt *CorruptDeltaError
+				require.ErrorAs(err, &corrupt, "truncated at %d", n)
+				require.ErrorIs(err, ErrCorruptDelta)
+				require.ErrorIs(err, io.ErrUnexpectedEOF)
+				if opts.Compression == NoCompression {
+					require.LessOrEqual(corrupt.Offset, int64(n))
+				}
+				require.GreaterOrEqual(corrupt.Index, index)
+				require.GreaterOrEqual(corrupt.Offset, offset)
+				if corrupt.Index > index {
+					require.Equal(corrupt.Index, index+1)
+					starts = append(starts, corrupt.Offset)
+					index = corrupt.Index
+				}
+				offset = corrupt.Offset
+			}
+		}
+		delta, err := ReadDelta(bytes.NewReader(b))
+		require.NoError(err)
+		require.Len(starts, len(delta)+1, "%+v", opts)
+
+		if opts.Compression == NoCompression && opts.Format == Native {
+			// an invalid instruction
+			corrupted := bytes.Clone(b)
+			corrupted[starts[1]] = 0xff
+			_, err = ReadDelta(bytes.NewReader(corrupted))
+			var corrupt *CorruptDeltaError
+			require.ErrorAs(err, &corrupt)
+			require.Equal(1, corrupt.Index)
+			require.Equal(starts[1], corrupt.Offset)
+			require.NotErrorIs(err, io.ErrUnexpectedEOF)
+		}
+	}
+}
+
+func TestErrorsDeltaReader(t *testing.T) {
+	require := require.New(t)
+
+	basis := bytes.Repeat([]byte(`ala ma kota,kot ma ale,`), 10)
+	sig, err := WriteSignature(bytes.NewReader(basis), io.Discard, 16, 8)
+	require.NoError(err)
+	buf := bytes.NewBuffer(nil)
+	require.NoError(WriteDelta(sig, bytes.NewReader(append([]byte(`toj es tto,`), basis...)), buf))
+
+	// errors of the underlying reader are not corrupt deltas
+	readErr := errors.New("read error")
+	for n := 0; n < buf.Len(); n++ {
+		r := io.MultiReader(bytes.NewReader(buf.Bytes()[:n]), &errReader{readErr})
+		_, err = ReadDelta(r)
+		require.ErrorIs(err, readErr, "failed at %d", n)
+		require.NotErrorIs(err, ErrCorruptDelta, "failed at %d", n)
+	}
+}
+
+func TestErrorsPatch(t *testing.T) {
+	require := require.New(t)
+
+	basis := bytes.Repeat([]byte(`ala ma kota,kot ma ale,`), 10)
+	sig, err := WriteSignature(bytes.NewReader(basis), io.Discard, 16, 8)
+	require.NoError(err)
+	buf := bytes.NewBuffer(nil)
+	require.NoError(WriteDelta(sig, bytes.NewReader(basis), buf))
+
+	err = Patch(bytes.NewReader(basis[:100]), bytes.NewReader(buf.Bytes()), io.Discard)
+	require.ErrorIs(err, ErrBasisTooShort)
+	require.ErrorIs(err, io.ErrUnexpectedEOF)
+	require.NotErrorIs(err, ErrCorruptDelta)
+
+	err = Patch(bytes.NewReader(bytes.ToUpper(basis)), bytes.NewReader(buf.Bytes()), io.Discard)
+	require.ErrorIs(err, ErrChecksumMismatch)
+
+	err = DeltaOptions{Format: Format(9)}.WriteDelta(sig, bytes.NewReader(basis), io.Discard)
+	require.ErrorIs(err, ErrInvalidOptions)
+
+	// the new file is shorter, or longer, than its length
+	err = WriteDelta(sig, &lengthReader{bytes.NewReader(basis[:100]), 200}, io.Discard)
+	require.ErrorIs(err, ErrLengthChanged)
+	require.ErrorIs(err, io.ErrUnexpectedEOF)
+	err = WriteDelta(sig, &lengthReader{bytes.NewReader(basis), 200}, io.Discard)
+	require.ErrorIs(err, ErrLengthChanged)
+	require.NotErrorIs(err, io.ErrUnexpectedEOF)
+	err = DeltaOptions{}.WriteDeltaAt(sig, bytes.NewReader(basis[:100]), 200, io.Discard)
+	require.ErrorIs(err, ErrLengthChanged)
+}
+
+type errReader struct {
+	err error
+}
+
+func (r *errReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
+
+// lengthReader tells a length, which may not be the length of the reader.
+type lengthReader struct {
+	io.Reader
+	n int
+}
+
+func (r *lengthReader) Len() int {
+	return r.n
+}
@@ -0,0 +1,136 @@
+package diff
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/md4"
+)
+
+type (
+	// WeakHash identifies the rolling checksum algorithm a signature was built with.
+	WeakHash byte
+
+	// StrongHash identifies the strong checksum algorithm a signature was built with.
+	StrongHash byte
+)
+
+const (
+	// Rollsum is the librsync "rollsum" rolling checksum.
+	Rollsum = WeakHash(0x0)
+	// RabinKarp is the librsync RabinKarp rolling hash.
+	RabinKarp = WeakHash(0x1)
+)
+
+const (
+	// MD5 is the MD5 message digest.
+	MD5 = StrongHash(0x0)
+	// SHA1 is the SHA-1 message digest.
+	SHA1 = StrongHash(0x1)
+	// SHA256 is the SHA-256 message digest.
+	SHA256 = StrongHash(0x2)
+	// BLAKE2b is the 256-bit BLAKE2b message digest.
+	BLAKE2b = StrongHash(0x3)
+	// MD4 is the MD4 message digest, only meant for librsync signatures.
+	MD4 = StrongHash(0x4)
+)
+
+// weakHashes is the registry of weak hash algorithms, indexed by their IDs.
+var weakHashes = []struct {
+	name     string
+	checksum func(p []byte) uint32
+	new      func() rollingHash
+}{
+	Rollsum:   {"rollsum", checksum32, func() rollingHash { return &rollsum{} }},
+	RabinKarp: {"rabinkarp", rabinKarp32, func() rollingHash { return newRabinKarp() }},
+}
+
+// strongHashes is the registry of strong hash algorithms, indexed by their IDs.
+var strongHashes = []struct {
+	name string
+	new  func() hash.Hash
+}{
+	MD5:    {"md5", md5.New},
+	SHA1:   {"sha1", sha1.New},
+	SHA256: {"sha256", sha256.New},
+	BLAKE2b: {"blake2b", func() hash.Hash {
+		h, _ := blake2b.New256(nil)
+		return h
+	}},
+	MD4: {"md4", md4.New},
+}
+
+// ParseWeakHash returns the weak hash algorithm with the given name (e.g. "rabinkarp").
+func ParseWeakHash(name string) (WeakHash, error) {
+	for id, h := range weakHashes {
+		if strings.EqualFold(h.name, name) {
+			return WeakHash(id), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown weak hash: %s", name)
+}
+
+// ParseStrongHash returns the strong hash algorithm with the given name (e.g. "sha256").
+func ParseStrongHash(name string) (StrongHash, error) {
+	for id, h := range strongHashes {
+		if strings.EqualFold(h.name, name) {
+			return StrongHash(id), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown strong hash: %s", name)
+}
+
+// Available reports whether the weak hash algorithm is known.
+func (h WeakHash) Available() bool {
+	return int(h) < len(weakHashes)
+}
+
+// checksum returns the weak checksum of p.
+func (h WeakHash) checksum(p []byte) uint32 {
+	return weakHashes[h].checksum(p)
+}
+
+// newRollingHash returns the rolling version of the weak checksum.
+func (h WeakHash) newRollingHash() rollingHash {
+	return weakHashes[h].new()
+}
+
+func (h WeakHash) String() string {
+	if h.Available() {
+		return weakHashes[h].name
+	}
+	return fmt.Sprintf("WeakHash(%d)", byte(h))
+}
+
+// Available reports whether the strong hash algorithm is known.
+func (h StrongHash) Available() bool {
+	return int(h) < len(strongHashes)
+}
+
+// New returns a new hash.Hash computing the strong checksum. It panics if the algorithm is not available.
+func (h StrongHash) New() hash.Hash {
+	if !h.Available() {
+		panic(fmt.Sprintf("diff: unavailable strong hash: %v", h))
+	}
+	return strongHashes[h].new()
+}
+
+// Size returns the digest length of the strong hash, or 0 if the algorithm is not available.
+func (h StrongHash) Size() int {
+	if !h.Available() {
+		return 0
+	}
+	return h.New().Size()
+}
+
+func (h StrongHash) String() string {
+	if h.Available() {
+		return strongHashes[h].name
+	}
+	return fmt.Sprintf("StrongHash(%d)", byte(h))
+}
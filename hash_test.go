@@ -0,0 +1,55 @@
+package diff
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStrongHash(t *testing.T) {
+	require := require.New(t)
+
+	for h, size := range map[StrongHash]int{MD5: 16, SHA1: 20, SHA256: 32, BLAKE2b: 32} {
+		require.True(h.Available())
+		require.Equal(size, h.Size())
+		require.Equal(size, h.New().Size())
+
+		p, err := ParseStrongHash(h.String())
+		require.NoError(err)
+		require.Equal(h, p)
+	}
+
+	p, err := ParseStrongHash("SHA256")
+	require.NoError(err)
+	require.Equal(SHA256, p)
+
+	_, err = ParseStrongHash("crc32")
+	require.Error(err)
+
+	h := StrongHash(0xff)
+	require.False(h.Available())
+	require.Zero(h.Size())
+	require.Panics(func() { h.New() })
+}
+
+func TestWeakHash(t *testing.T) {
+	require := require.New(t)
+
+	for _, h := range []WeakHash{Rollsum, RabinKarp} {
+		require.True(h.Available())
+
+		p, err := ParseWeakHash(h.String())
+		require.NoError(err)
+		require.Equal(h, p)
+
+		rh := h.newRollingHash()
+		for _, b := range []byte(`ala ma kota`) {
+			rh.rollin([]byte{b})
+		}
+		require.Equal(h.checksum([]byte(`ala ma kota`)), rh.sum())
+	}
+
+	_, err := ParseWeakHash("adler32")
+	require.Error(err)
+	require.False(WeakHash(0xff).Available())
+}
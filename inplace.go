@@ -0,0 +1,303 @@
+package diff
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+type (
+	// InPlaceFile is a basis file which is patched in place, e.g. an *os.File opened for reading and writing.
+	InPlaceFile interface {
+		io.ReaderAt
+		io.WriterAt
+		Truncate(size int64) error
+	}
+
+	// inPlaceCopy copies a basis range to its offset in the new file, within the same file.
+	inPlaceCopy struct {
+		src, dst, size uint64
+		// data is the source, read ahead to break a cycle of copies.
+		data []byte
+	}
+
+	// inPlaceLiteral is literal data of the new file, kept in memory if the delta cannot be read twice.
+	inPlaceLiteral struct {
+		dst  uint64
+		data []byte
+	}
+)
+
+// PatchInPlace recreates the new file from the basis and the delta, in the basis file itself.
+// See PatchOptions.PatchInPlace.
+func PatchInPlace(file InPlaceFile, deltaReader io.Reader) error {
+	return PatchOptions{}.PatchInPlace(file, deltaReader)
+}
+
+// PatchInPlace recreates the new file from the basis and the delta, in the basis file itself (like rsync --inplace),
+// and truncates it to the length of the new file.
+//
+// The whole delta is read first, so truncated or corrupt deltas are rejected before the file is modified.
+// Copies are split in chunks of BufferSize bytes, and ordered so that no basis range is overwritten before all chunks reading it are done;
+// chunks depending on each other in a cycle are broken up by reading one of them ahead, into memory.
+// Literal data is written last: it is read again from the delta if the delta can be seeked, otherwise it is kept in memory.
+//
+// Once the file is modified the basis is lost, so a delta which does not apply to it (see VerifyBasis) destroys it.
+// Legacy deltas are not supported, as they may overstate the size of the final basis block.
+func (o PatchOptions) PatchInPlace(file InPlaceFile, deltaReader io.Reader) error {
+	seeker, seekable := deltaReader.(io.Seeker)
+	start := int64(0)
+	if seekable {
+		var err error
+		// e.g. an *os.File which is a pipe
+		if start, err = seeker.Seek(0, io.SeekCurrent); err != nil {
+			seekable = false
+		}
+	}
+
+	dr, err := newDeltaReader(deltaReader)
+	if err != nil {
+		return err
+	}
+	if dr.header.legacy() {
+		return fmt.Errorf("legacy deltas cannot be patched in place: %w", errors.ErrUnsupported)
+	}
+	if o.VerifyBasis {
+		if err = VerifyBasis(io.NewSectionReader(file, 0, math.MaxInt64), dr.header); err != nil {
+			return err
+		}
+	}
+
+	bufferSize := o.BufferSize
+	if bufferSize <= 0 {
+		bufferSize = defaultChunkSize
+	}
+	copies, literals, length, err := readInPlace(dr, uint64(bufferSize), !seekable)
+	if err != nil {
+		return err
+	}
+	if err = checkBasisLength(file, copies); err != nil {
+		return err
+	}
+
+	if err = runInPlace(file, copies, make([]byte, bufferSize)); err != nil {
+		return err
+	}
+
+	if seekable {
+		// read the literal data again
+		if _, err = seeker.Seek(start, io.SeekStart); err != nil {
+			return err
+		}
+		if dr, err = newDeltaReader(deltaReader); err != nil {
+			return err
+		}
+		if err = writeInPlaceLiterals(file, dr); err != nil {
+			return err
+		}
+	} else {
+		for _, l := range literals {
+			if _, err = file.WriteAt(l.data, int64(l.dst)); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err = file.Truncate(int64(length)); err != nil {
+		return err
+	}
+	if dr.digest != nil {
+		digest := dr.header.StrongHash.New()
+		if _, err = io.Copy(digest, io.NewSectionReader(file, 0, int64(length))); err != nil {
+			return err
+		}
+		if !bytes.Equal(dr.digest, digest.Sum(nil)) {
+			return fmt.Errorf("recreated file: %w", ErrChecksumMismatch)
+		}
+	}
+	return nil
+}
+
+// readInPlace reads all instructions from dr, and returns the copies split in chunks of chunkSize bytes
+// (except those which are already in place), the literals (if keepLiterals is set) and the length of the new file.
+func readInPlace(dr *deltaReader, chunkSize uint64, keepLiterals bool) (copies []*inPlaceCopy, literals []inPlaceLiteral, length uint64, err error) {
+	for {
+		i, err := dr.next()
+		if err != nil {
+			if err == io.EOF {
+				return copies, literals, length, nil
+			}
+			return nil, nil, 0, err
+		}
+
+		if i.From == FromOld {
+			if i.Offset != length {
+				for n := uint64(0); n < i.Size; n += chunkSize {
+					copies = append(copies, &inPlaceCopy{src: i.Offset + n, dst: length + n, size: min(chunkSize, i.Size-n)})
+				}
+			}
+		} else if i.From == FromNew {
+			if !keepLiterals {
+				if err = dr.copyData(io.Discard, i.Size, nil); err != nil {
+					return nil, nil, 0, err
+				}
+			} else {
+				buf := bytes.NewBuffer(nil)
+				if err = dr.copyData(buf, i.Size, nil); err != nil {
+					return nil, nil, 0, err
+				}
+				literals = append(literals, inPlaceLiteral{dst: length, data: buf.Bytes()})
+			}
+		}
+		length += i.Size
+	}
+}
+
+// checkBasisLength checks that the basis covers all copies, before anything is written.
+func checkBasisLength(r io.ReaderAt, copies []*inPlaceCopy) error {
+	end := uint64(0)
+	for _, c := range copies {
+		end = max(end, c.src+c.size)
+	}
+	if end == 0 {
+		return nil
+	}
+
+	var b [1]byte
+	if n, err := r.ReadAt(b[:], int64(end-1)); n < 1 {
+		if err == nil || err == io.EOF {
+			return ErrBasisTooShort
+		}
+		return err
+	}
+	return nil
+}
+
+// runInPlace runs the copies in an order where every basis range is read before it is overwritten (Kahn's algorithm).
+// A copy has to run before every copy writing over its source. If the remaining copies form cycles,
+// one of them is read ahead, so it does not have to run before any other copy.
+// Copies are chunks of at most len(buf) bytes, which bounds both the sources scanned for every destination
+// and the memory a copy read ahead takes.
+func runInPlace(f InPlaceFile, copies []*inPlaceCopy, buf []byte) error {
+	// copies sorted by their sources
+	bySrc := make([]int, len(copies))
+	maxSize := uint64(0)
+	for n, c := range copies {
+		bySrc[n] = n
+		maxSize = max(maxSize, c.size)
+	}
+	sort.Slice(bySrc, func(i, j int) bool { return copies[bySrc[i]].src < copies[bySrc[j]].src })
+
+	// after[a] are the copies overwriting the source of a, deps[b] is the number of copies b waits for
+	after := make([][]int, len(copies))
+	deps := make([]int, len(copies))
+	for b, c := range copies {
+		// copies with a source starting before the end of c.dst
+		k := sort.Search(len(bySrc), func(n int) bool { return copies[bySrc[n]].src >= c.dst+c.size })
+		for k--; k >= 0 && copies[bySrc[k]].src+maxSize > c.dst; k-- {
+			a := bySrc[k]
+			if a != b && copies[a].src+copies[a].size > c.dst {
+				after[a] = append(after[a], b)
+				deps[b]++
+			}
+		}
+	}
+
+	queue := make([]int, 0, len(copies))
+	for n := range copies {
+		if deps[n] == 0 {
+			queue = append(queue, n)
+		}
+	}
+	release := func(a int) {
+		for _, b := range after[a] {
+			if deps[b]--; deps[b] == 0 {
+				queue = append(queue, b)
+			}
+		}
+		after[a] = nil
+	}
+
+	// waiting copies others wait for only ever become fewer, so they are looked for from the last one read ahead
+	next := 0
+	for done := 0; done < len(copies); {
+		if len(queue) == 0 {
+			// cycle: read a waiting copy ahead
+			for deps[next] == 0 || len(after[next]) == 0 {
+				next++
+			}
+			a := next
+			c := copies[a]
+			c.data = make([]byte, c.size)
+			if _, err := f.ReadAt(c.data, int64(c.src)); err != nil && err != io.EOF {
+				return err
+			}
+			release(a)
+			continue
+		}
+
+		a := queue[0]
+		queue = queue[1:]
+		if err := copies[a].run(f, buf); err != nil {
+			return err
+		}
+		// a copy read ahead has released its dependents already
+		release(a)
+		done++
+	}
+	return nil
+}
+
+// run copies the source to the destination. If both overlap, chunks are copied in the direction
+// which reads every chunk before it is overwritten.
+func (c *inPlaceCopy) run(f InPlaceFile, buf []byte) error {
+	if c.data != nil {
+		_, err := f.WriteAt(c.data, int64(c.dst))
+		return err
+	}
+
+	backward := c.dst > c.src && c.dst < c.src+c.size
+	for done := uint64(0); done < c.size; {
+		n := min(uint64(len(buf)), c.size-done)
+		off := done
+		if backward {
+			off = c.size - done - n
+		}
+
+		if k, err := f.ReadAt(buf[:n], int64(c.src+off)); uint64(k) < n {
+			if err == nil || err == io.EOF {
+				return ErrBasisTooShort
+			}
+			return err
+		}
+		if _, err := f.WriteAt(buf[:n], int64(c.dst+off)); err != nil {
+			return err
+		}
+		done += n
+	}
+	return nil
+}
+
+// writeInPlaceLiterals writes the literal data read from dr at its offsets in the new file.
+func writeInPlaceLiterals(f InPlaceFile, dr *deltaReader) error {
+	length := uint64(0)
+	for {
+		i, err := dr.next()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		if i.From == FromNew {
+			if err = dr.copyData(io.NewOffsetWriter(f, int64(length)), i.Size, nil); err != nil {
+				return err
+			}
+		}
+		length += i.Size
+	}
+}
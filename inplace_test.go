@@ -0,0 +1,193 @@
+package diff
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPatchInPlace(t *testing.T) {
+	require := require.New(t)
+
+	const blockSize = 64
+	rnd := rand.New(rand.NewSource(1))
+	for n := 0; n < 200; n++ {
+		basis := make([]byte, blockSize*(1+rnd.Intn(64))+rnd.Intn(blockSize))
+		rnd.Read(basis)
+
+		// shuffle, duplicate, drop and insert blocks (and unaligned ranges)
+		var newData []byte
+		for k := rnd.Intn(100); k >= 0; k-- {
+			switch rnd.Intn(4) {
+			case 0:
+				newData = append(newData, []byte("literal")[:rnd.Intn(8)]...)
+			case 1:
+				off := rnd.Intn(len(basis))
+				newData = append(newData, basis[off:min(len(basis), off+rnd.Intn(3*blockSize))]...)
+			default:
+				off := rnd.Intn(len(basis)/blockSize) * blockSize
+				newData = append(newData, basis[off:min(len(basis), off+blockSize)]...)
+			}
+		}
+
+		sig, err := WriteSignature(bytes.NewReader(basis), bytes.NewBuffer(nil), blockSize, 8)
+		require.NoError(err)
+		delta := bytes.NewBuffer(nil)
+		err = WriteDelta(sig, bytes.NewReader(newData), delta)
+		require.NoError(err)
+
+		for _, opts := range []PatchOptions{{}, {BufferSize: 7, VerifyBasis: true}} {
+			f := &memFile{buf: append([]byte{}, basis...)}
+			err = opts.PatchInPlace(f, bytes.NewReader(delta.Bytes()))
+			require.NoError(err)
+			require.Equal(newData, f.buf, "case %d", n)
+
+			// literals are kept in memory
+			f = &memFile{buf: append([]byte{}, basis...)}
+			err = opts.PatchInPlace(f, struct{ io.Reader }{bytes.NewReader(delta.Bytes())})
+			require.NoError(err)
+			require.Equal(newData, f.buf, "case %d", n)
+		}
+	}
+}
+
+func TestPatchInPlaceCycle(t *testing.T) {
+	require := require.New(t)
+
+	const blockSize = 4
+	basis := []byte(`aaaabbbbccccdddd`)
+	// swapped blocks depend on each other, and a block moved by less than its size overlaps itself
+	for _, text := range []string{`bbbbaaaaddddcccc`, `ddddaaaabbbbcccc`, `xxaaaabbbbccccdddd`, `bbbbccccdddd`} {
+		sig, err := WriteSignature(bytes.NewReader(basis), bytes.NewBuffer(nil), blockSize, 8)
+		require.NoError(err)
+		delta := bytes.NewBuffer(nil)
+		err = WriteDelta(sig, strings.NewReader(text), delta)
+		require.NoError(err)
+
+		for _, bufferSize := range []int{0, 1, 3} {
+			f := &memFile{buf: append([]byte{}, basis...)}
+			err = PatchOptions{BufferSize: bufferSize}.PatchInPlace(f, bytes.NewReader(delta.Bytes()))
+			require.NoError(err)
+			require.Equal(text, string(f.buf))
+		}
+	}
+}
+
+func TestPatchInPlaceChunks(t *testing.T) {
+	require := require.New(t)
+
+	rnd := rand.New(rand.NewSource(1))
+	basis := make([]byte, 64*1024)
+	rnd.Read(basis)
+	// swapped halves depend on each other, and a range moved by one byte overlaps itself
+	for _, newData := range [][]byte{
+		append(append([]byte{}, basis[32*1024:]...), basis[:32*1024]...),
+		append([]byte{'x'}, basis...),
+	} {
+		sig, err := WriteSignature(bytes.NewReader(basis), bytes.NewBuffer(nil), 512, 8)
+		require.NoError(err)
+		delta := bytes.NewBuffer(nil)
+		err = WriteDelta(sig, bytes.NewReader(newData), delta)
+		require.NoError(err)
+
+		const bufferSize = 1000
+		dr, err := newDeltaReader(bytes.NewReader(delta.Bytes()))
+		require.NoError(err)
+		copies, _, _, err := readInPlace(dr, bufferSize, false)
+		require.NoError(err)
+		f := &memFile{buf: append([]byte{}, basis...)}
+		err = runInPlace(f, copies, make([]byte, bufferSize))
+		require.NoError(err)
+		for _, c := range copies {
+			require.LessOrEqual(c.size, uint64(bufferSize))
+			require.LessOrEqual(len(c.data), bufferSize)
+		}
+
+		f = &memFile{buf: append([]byte{}, basis...)}
+		err = PatchOptions{BufferSize: bufferSize}.PatchInPlace(f, bytes.NewReader(delta.Bytes()))
+		require.NoError(err)
+		require.Equal(newData, f.buf)
+	}
+}
+
+func TestPatchInPlaceErrors(t *testing.T) {
+	require := require.New(t)
+
+	sig, err := WriteSignature(strings.NewReader(basisText), bytes.NewBuffer(nil), blockSize, strongSize)
+	require.NoError(err)
+	delta := bytes.NewBuffer(nil)
+	err = WriteDelta(sig, strings.NewReader(newText), delta)
+	require.NoError(err)
+
+	// nothing is written
+	basis := basisText[:len(basisText)-1]
+	f := &memFile{buf: []byte(basis)}
+	err = PatchInPlace(f, bytes.NewReader(delta.Bytes()))
+	require.ErrorIs(err, io.ErrUnexpectedEOF)
+	require.Equal(basis, string(f.buf))
+
+	f = &memFile{buf: []byte(basisText)}
+	err = PatchInPlace(f, bytes.NewReader(delta.Bytes()[:delta.Len()-1]))
+	require.ErrorIs(err, io.ErrUnexpectedEOF)
+	require.Equal(basisText, string(f.buf))
+
+	basis = strings.ToUpper(basisText)
+	f = &memFile{buf: []byte(basis)}
+	err = PatchOptions{VerifyBasis: true}.PatchInPlace(f, bytes.NewReader(delta.Bytes()))
+	require.ErrorIs(err, ErrChecksumMismatch)
+	require.Equal(basis, string(f.buf))
+
+	// the basis is lost
+	err = PatchInPlace(f, bytes.NewReader(delta.Bytes()))
+	require.ErrorIs(err, ErrChecksumMismatch)
+
+	legacy := bytes.NewBuffer(nil)
+	i := &DeltaInstruction{DeltaInstructionHeader: DeltaInstructionHeader{From: FromOld, Offset: 0, Size: 11}}
+	require.NoError(i.writeTo(legacy))
+	f = &memFile{buf: []byte(basisText)}
+	err = PatchInPlace(f, legacy)
+	require.Error(err)
+	require.Equal(basisText, string(f.buf))
+}
+
+func TestPatchInPlaceFile(t *testing.T) {
+	require := require.New(t)
+	setup(t)
+	defer tearDown(t)
+
+	f, err := os.OpenFile(basisFile.Name(), os.O_RDWR, 0)
+	require.NoError(err)
+	defer f.Close()
+
+	err = PatchOptions{VerifyBasis: true}.PatchInPlace(f, deltaFile)
+	require.NoError(err)
+
+	b, err := os.ReadFile(f.Name())
+	require.NoError(err)
+	require.EqualValues(newText, string(b))
+
+	// a pipe is an *os.File which cannot be seeked, so literals are kept in memory
+	require.NoError(f.Truncate(0))
+	_, err = f.WriteAt([]byte(basisText), 0)
+	require.NoError(err)
+	_, err = deltaFile.Seek(0, io.SeekStart)
+	require.NoError(err)
+	pr, pw, err := os.Pipe()
+	require.NoError(err)
+	defer pr.Close()
+	go func() {
+		io.Copy(pw, deltaFile)
+		pw.Close()
+	}()
+	err = PatchOptions{VerifyBasis: true}.PatchInPlace(f, pr)
+	require.NoError(err)
+
+	b, err = os.ReadFile(f.Name())
+	require.NoError(err)
+	require.EqualValues(newText, string(b))
+}
@@ -0,0 +1,413 @@
+package diff
+
+import (
+	"fmt"
+	"hash"
+	"io"
+	"runtime"
+	"sync"
+)
+
+// sigBatch is a run of basis blocks, checksummed by a single worker.
+type sigBatch struct {
+	index int
+	// data is the basis data of the batch, the final block may be short.
+	data []byte
+	// sums are the weak and strong checksums of the blocks, as written out.
+	sums []byte
+	err  error
+}
+
+// WriteSignatureAt generates the signature of basisLength bytes of basisReaderAt, and writes it out to signatureWriter.
+// Blocks are read and checksummed by Workers goroutines, and written out in order,
+// so the signature is identical to the one written by WriteSignature.
+// The digest of the whole basis (recorded in native signatures) is still computed in the calling goroutine, unless NoDigest.
+func (o SignatureOptions) WriteSignatureAt(basisReaderAt io.ReaderAt, basisLength int64, signatureWriter io.Writer) (*Signature, error) {
+	o, err := o.withSizes(uint64(basisLength))
+	if err != nil {
+		return nil, err
+	}
+	if o.Workers <= 0 {
+		o.Workers = runtime.GOMAXPROCS(0)
+	}
+
+	return o.writeSignature(func(w io.Writer, digest hash.Hash) (signatureChecksum, uint64, error) {
+		return writeSignatureChecksumParallel(nil, basisReaderAt, basisLength, w, digest, o)
+	}, uint64(basisLength), signatureWriter)
+}
+
+// writeSignatureChecksumParallel is writeSignatureChecksum with Workers goroutines.
+// The basis is read in batches of blocks either from r (in order), or from ra (by the workers, up to length).
+func writeSignatureChecksumParallel(r io.Reader, ra io.ReaderAt, length int64, w io.Writer, digest hash.Hash, o SignatureOptions) (signatureChecksum, uint64, error) {
+	blocks := max(1, defaultChunkSize/int(o.BlockSize))
+	batchSize := blocks * int(o.BlockSize)
+
+	// batches in flight, reused once written out
+	free := make(chan *sigBatch, 2*o.Workers)
+	for n := 0; n < cap(free); n++ {
+		free <- &sigBatch{data: make([]byte, batchSize)}
+	}
+	jobs := make(chan *sigBatch)
+	results := make(chan *sigBatch)
+	done := make(chan struct{})
+
+	// producer
+	go func() {
+		defer close(jobs)
+		for index := 0; ra == nil || int64(index)*int64(batchSize) < length; index++ {
+			var b *sigBatch
+			select {
+			case b = <-free:
+			case <-done:
+				return
+			}
+			b.index, b.data, b.err = index, b.data[:batchSize], nil
+
+			eof := false
+			if ra == nil {
+				n, err := io.ReadFull(r, b.data)
+				b.data = b.data[:n]
+				if err == io.EOF || err == io.ErrUnexpectedEOF {
+					eof = true
+				} else if err != nil {
+					b.err = err
+				}
+				if n == 0 && b.err == nil {
+					return
+				}
+			} else if remaining := length - int64(index)*int64(batchSize); remaining < int64(batchSize) {
+				b.data = b.data[:remaining]
+			}
+
+			// b belongs to the workers once sent
+			last := eof || b.err != nil
+			select {
+			case jobs <- b:
+			case <-done:
+				return
+			}
+			if last {
+				return
+			}
+		}
+	}()
+
+	// workers
+	var wg sync.WaitGroup
+	for n := 0; n < o.Workers; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			h := o.StrongHash.New()
+			for b := range jobs {
+				if b.err == nil && ra != nil {
+					off := int64(b.index) * int64(batchSize)
+					if n, err := ra.ReadAt(b.data, off); n < len(b.data) {
+						b.err = err
+						if err == nil || err == io.EOF {
+							b.err = ErrBasisTooShort
+						}
+					}
+				}
+				if b.err == nil {
+					b.sums = sumBlocks(b.sums[:0], b.data, o, h)
+				}
+				results <- b
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	// write out batches in order
+	checksum := newSignatureChecksum(o.StrongSize, uint64(length)/uint64(o.BlockSize))
+	total := uint64(0)
+	pending := make(map[int]*sigBatch)
+	next := 0
+	var err error
+	for b := range results {
+		if err != nil {
+			continue
+		}
+		pending[b.index] = b
+		for b = pending[next]; b != nil && err == nil; b = pending[next] {
+			delete(pending, next)
+			next++
+
+			if err = b.err; err == nil {
+				err = writeSigBatch(b, w, digest, &checksum, o.StrongSize)
+			}
+			total += uint64(len(b.data))
+			if err != nil {
+				close(done)
+				break
+			}
+			free <- b
+		}
+	}
+	if err != nil {
+		return signatureChecksum{}, 0, err
+	}
+	checksum.sort()
+	return checksum, total, nil
+}
+
+// sumBlocks appends the checksums of all blocks of data to sums.
+func sumBlocks(sums []byte, data []byte, o SignatureOptions, h hash.Hash) []byte {
+	for len(data) > 0 {
+		block := data[:min(len(data), int(o.BlockSize))]
+		data = data[len(block):]
+
+		sums = byteOrder.AppendUint32(sums, o.WeakHash.checksum(block))
+		h.Reset()
+		h.Write(block)
+		sums = append(sums, h.Sum(nil)[:o.StrongSize]...)
+	}
+	return sums
+}
+
+// writeSigBatch writes the checksums of a batch out to w, adds them to checksum, and writes the basis data to digest.
+func writeSigBatch(b *sigBatch, w io.Writer, digest hash.Hash, checksum *signatureChecksum, strongSize byte) error {
+	if digest != nil {
+		digest.Write(b.data)
+	}
+	if _, err := w.Write(b.sums); err != nil {
+		return err
+	}
+
+	for sums := b.sums; len(sums) > 0; sums = sums[4+int(strongSize):] {
+		if err := checksum.add(byteOrder.Uint32(sums[:4]), sums[4:]); err != nil {
+			return fmt.Errorf("%w: %w, the block size is too small", ErrInvalidOptions, err)
+		}
+	}
+	return nil
+}
+
+// minSegmentSize is the smallest range of the new file scanned by a single WriteDeltaAt worker.
+const minSegmentSize = 4 * defaultChunkSize
+
+type (
+	// deltaSegment is a range of the new file, scanned by a single worker.
+	deltaSegment struct {
+		index      int
+		start, end uint64
+		// instr are the instructions from start, past end by up to a block, so a copy spanning end is matched.
+		instr []*DeltaInstruction
+		err   error
+	}
+
+	// collectWriter keeps instructions in memory.
+	collectWriter struct {
+		instr []*DeltaInstruction
+	}
+
+	// deltaStitcher writes the instructions of consecutive segments out as a single delta.
+	deltaStitcher struct {
+		w       instructionWriter
+		ra      io.ReaderAt
+		inOrder bool
+		// i is the pending instruction, copyEnd the end of the previous copy.
+		i       DeltaInstruction
+		copyEnd uint64
+	}
+)
+
+// WriteDeltaAt writes the delta between the basis (described by signature) and newLength bytes of newReaderAt
+// out to deltaWriter. The new file is split in segments (of at least 4MB), which are scanned by Workers goroutines.
+// A segment is scanned up to a block past its end, and the instructions of consecutive segments are stitched
+// after the copy spanning their boundary (if any), so matches are not lost at the boundaries.
+// With InOrder, copies going backwards across segments are written as literal data.
+// The digest of the whole new file is computed while stitching, in the calling goroutine, unless NoDigest.
+func (o DeltaOptions) WriteDeltaAt(signature *Signature, newReaderAt io.ReaderAt, newLength int64, deltaWriter io.Writer) error {
+	if o.Workers <= 0 {
+		o.Workers = runtime.GOMAXPROCS(0)
+	}
+
+	return o.writeDelta(signature, uint64(newLength), func(w instructionWriter, digest hash.Hash) (uint64, error) {
+		segmentSize := max(minSegmentSize, 64*uint64(signature.BlockSize))
+		return writeDeltaInstructionsParallel(signature, newReaderAt, uint64(newLength), segmentSize, w, digest, o)
+	}, deltaWriter)
+}
+
+// writeDeltaInstructionsParallel scans segments of segmentSize bytes (at least a block) concurrently,
+// and writes the stitched instructions out to w.
+func writeDeltaInstructionsParallel(signature *Signature, ra io.ReaderAt, length, segmentSize uint64, w instructionWriter, digest hash.Hash, o DeltaOptions) (uint64, error) {
+	blockSize := uint64(signature.BlockSize)
+	// the filter is shared by all workers
+	filter := newWeakFilter(signature)
+
+	// segments in flight, until they are written out
+	sem := make(chan struct{}, 2*o.Workers)
+	jobs := make(chan *deltaSegment)
+	results := make(chan *deltaSegment)
+	done := make(chan struct{})
+
+	// producer
+	go func() {
+		defer close(jobs)
+		for index, start := 0, uint64(0); start < length; index, start = index+1, start+segmentSize {
+			select {
+			case sem <- struct{}{}:
+			case <-done:
+				return
+			}
+			select {
+			case jobs <- &deltaSegment{index: index, start: start, end: min(length, start+segmentSize)}:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	// workers
+	var wg sync.WaitGroup
+	for n := 0; n < o.Workers; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for seg := range jobs {
+				select {
+				case <-done:
+					// drain
+				default:
+					seg.scan(signature, filter, ra, min(length, seg.end+blockSize), o)
+				}
+				results <- seg
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	// stitch segments in order
+	st := &deltaStitcher{w: w, ra: ra, inOrder: o.InOrder}
+	pending := make(map[int]*deltaSegment)
+	next := 0
+	pos := uint64(0)
+	var err error
+	for seg := range results {
+		if err != nil {
+			continue
+		}
+		pending[seg.index] = seg
+		for seg = pending[next]; seg != nil && err == nil; seg = pending[next] {
+			delete(pending, next)
+			next++
+
+			if err = seg.err; err == nil && digest != nil {
+				_, err = io.Copy(digest, io.NewSectionReader(ra, int64(seg.start), int64(seg.end-seg.start)))
+			}
+			if err == nil {
+				cut := seg.cut()
+				err = st.write(seg, pos, cut)
+				pos = cut
+			}
+			if err != nil {
+				close(done)
+				break
+			}
+			<-sem
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+	if err = st.i.flush(w); err != nil {
+		return 0, err
+	}
+	return length, nil
+}
+
+// scan matches the segment (up to scanEnd) against the signature.
+func (seg *deltaSegment) scan(signature *Signature, filter *weakFilter, ra io.ReaderAt, scanEnd uint64, o DeltaOptions) {
+	w := &collectWriter{}
+	n, err := writeDeltaInstructions(signature, filter, io.NewSectionReader(ra, int64(seg.start), int64(scanEnd-seg.start)), w, o)
+	if err == nil && n < scanEnd-seg.start {
+		err = fmt.Errorf("%w: segment ends at %d, read %d: %w", ErrLengthChanged, scanEnd, seg.start+n, io.ErrUnexpectedEOF)
+	}
+	seg.instr, seg.err = w.instr, err
+}
+
+// cut returns where the instructions of the segment end: at the end of the segment,
+// or at the end of a copy spanning it (the next segment's instructions are used from there on).
+func (seg *deltaSegment) cut() uint64 {
+	pos := seg.start
+	for _, i := range seg.instr {
+		next := pos + i.Size
+		if next > seg.end {
+			if i.From == FromOld && pos < seg.end {
+				return next
+			}
+			break
+		}
+		pos = next
+	}
+	return seg.end
+}
+
+// write writes the instructions of the segment between from and to (in the new file) out.
+func (st *deltaStitcher) write(seg *deltaSegment, from, to uint64) error {
+	pos := seg.start
+	for _, i := range seg.instr {
+		next := pos + i.Size
+		if next > from && pos < to {
+			// trim the instruction to [from, to)
+			d, e := max(from, pos)-pos, min(to, next)-pos
+			part := &DeltaInstruction{DeltaInstructionHeader: DeltaInstructionHeader{From: i.From, Offset: i.Offset, Size: e - d}}
+			if i.From == FromOld {
+				part.Offset += d
+			} else {
+				part.Data = i.Data[d:e:e]
+			}
+			if err := st.emit(part, pos+d); err != nil {
+				return err
+			}
+		}
+		pos = next
+	}
+	return nil
+}
+
+// emit appends an instruction recreating the new file from pos on.
+func (st *deltaStitcher) emit(i *DeltaInstruction, pos uint64) error {
+	if i.From == FromOld && st.inOrder && i.Offset < st.copyEnd {
+		// the part going backwards is written as literal data
+		n := min(i.Size, st.copyEnd-i.Offset)
+		data := make([]byte, n)
+		if _, err := st.ra.ReadAt(data, int64(pos)); err != nil {
+			return err
+		}
+		if err := st.i.append(st.w, &DeltaInstruction{
+			DeltaInstructionHeader: DeltaInstructionHeader{From: FromNew, Size: n},
+			Data:                   data,
+		}); err != nil {
+			return err
+		}
+		if i.Size == n {
+			return nil
+		}
+		i = &DeltaInstruction{DeltaInstructionHeader: DeltaInstructionHeader{From: FromOld, Offset: i.Offset + n, Size: i.Size - n}}
+	}
+
+	if i.From == FromOld {
+		st.copyEnd = i.Offset + i.Size
+	}
+	return st.i.append(st.w, i)
+}
+
+func (w *collectWriter) writeInstruction(i *DeltaInstruction) error {
+	c := *i
+	c.Data = append([]byte(nil), i.Data...)
+	w.instr = append(w.instr, &c)
+	return nil
+}
+
+func (w *collectWriter) writeEnd(uint64) error {
+	return nil
+}
@@ -0,0 +1,198 @@
+package diff
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math/rand"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteSignatureParallel(t *testing.T) {
+	require := require.New(t)
+
+	rnd := rand.New(rand.NewSource(1))
+	data := make([]byte, 3*defaultChunkSize+12345)
+	rnd.Read(data)
+	// repeated blocks
+	copy(data[100000:], data[:50000])
+
+	for _, opts := range []SignatureOptions{
+		{BlockSize: 1000, StrongSize: 8},
+		{BlockSize: 1000, StrongSize: 8, NoDigest: true},
+		{BlockSize: 1024, StrongSize: 32, WeakHash: RabinKarp, StrongHash: SHA256},
+		{BlockSize: 2 * defaultChunkSize, StrongSize: 4},
+		{Format: Rdiff, BlockSize: 777, StrongSize: 16, StrongHash: BLAKE2b},
+		{},
+	} {
+		for _, length := range []int{0, 1, 999, 1000, 4000, defaultChunkSize, len(data)} {
+			expected := bytes.NewBuffer(nil)
+			sig1, err := opts.WriteSignature(bytes.NewReader(data[:length]), expected)
+			require.NoError(err)
+
+			for _, workers := range []int{0, 1, 2, 7} {
+				opts := opts
+				opts.Workers = workers
+				// a stream does not tell its length
+				opts.BlockSize, opts.StrongSize = sig1.BlockSize, sig1.StrongSize
+
+				buf := bytes.NewBuffer(nil)
+				sig2, err := opts.WriteSignatureAt(bytes.NewReader(data[:length]), int64(length), buf)
+				require.NoError(err)
+				require.Equal(expected.Bytes(), buf.Bytes())
+				require.EqualValues(sig1, sig2)
+
+				if workers > 1 {
+					buf.Reset()
+					sig2, err = opts.WriteSignature(iotest.HalfReader(bytes.NewReader(data[:length])), buf)
+					require.NoError(err)
+					require.Equal(expected.Bytes(), buf.Bytes())
+					require.EqualValues(sig1, sig2)
+				}
+			}
+		}
+	}
+}
+
+func TestWriteSignatureParallelErrors(t *testing.T) {
+	require := require.New(t)
+
+	data := make([]byte, 5*defaultChunkSize)
+	opts := SignatureOptions{BlockSize: 512, StrongSize: 8, Workers: 4}
+
+	errRead := errors.New("read")
+	r := io.MultiReader(bytes.NewReader(data[:3*defaultChunkSize+10]), iotest.ErrReader(errRead))
+	_, err := opts.WriteSignature(r, bytes.NewBuffer(nil))
+	require.ErrorIs(err, errRead)
+
+	_, err = opts.WriteSignatureAt(bytes.NewReader(data), int64(len(data))+1, bytes.NewBuffer(nil))
+	require.ErrorIs(err, io.ErrUnexpectedEOF)
+
+	opts.Format = Rdiff
+	opts.StrongHash = MD4
+	_, err = opts.WriteSignatureAt(bytes.NewReader(data), int64(len(data)), errWriter{})
+	require.Error(err)
+}
+
+func TestWriteDeltaParallel(t *testing.T) {
+	require := require.New(t)
+
+	rnd := rand.New(rand.NewSource(2))
+	basis := make([]byte, 20000)
+	rnd.Read(basis)
+	// moved, repeated, changed and inserted ranges
+	newData := append([]byte(nil), basis[5000:9000]...)
+	newData = append(newData, basis[:5000]...)
+	newData = append(newData, basis[:3000]...)
+	newData = append(newData, []byte("inserted")...)
+	newData = append(newData, basis[9000:]...)
+	newData[15000] ^= 0xff
+
+	sig, err := SignatureOptions{BlockSize: 256, StrongSize: 8}.WriteSignature(bytes.NewReader(basis), bytes.NewBuffer(nil))
+	require.NoError(err)
+
+	for _, opts := range []DeltaOptions{{}, {InOrder: true}, {Encoding: CompactEncoding}, {NoDigest: true}, {Format: Rdiff}} {
+		for _, length := range []int{0, 1, 255, 256, 4000, len(newData)} {
+			expected := bytes.NewBuffer(nil)
+			require.NoError(opts.WriteDelta(sig, bytes.NewReader(newData[:length]), expected))
+
+			// a single segment
+			opts.Workers = 2
+			delta := bytes.NewBuffer(nil)
+			require.NoError(opts.WriteDeltaAt(sig, bytes.NewReader(newData[:length]), int64(length), delta))
+			require.Equal(expected.Bytes(), delta.Bytes())
+
+			for _, segmentSize := range []uint64{256, 300, 1000, 4096} {
+				for _, workers := range []int{1, 3} {
+					opts.Workers = workers
+					ra := bytes.NewReader(newData[:length])
+					delta.Reset()
+					err = opts.writeDelta(sig, uint64(length), func(w instructionWriter, digest hash.Hash) (uint64, error) {
+						return writeDeltaInstructionsParallel(sig, ra, uint64(length), segmentSize, w, digest, opts)
+					}, delta)
+					require.NoError(err)
+
+					buf := bytes.NewBuffer(nil)
+					if opts.InOrder {
+						require.NoError(PatchStream(bytes.NewReader(basis), bytes.NewReader(delta.Bytes()), buf))
+					} else {
+						require.NoError(Patch(bytes.NewReader(basis), bytes.NewReader(delta.Bytes()), buf))
+					}
+					require.Equal(string(newData[:length]), buf.String())
+					// matches across segment boundaries are not lost
+					require.LessOrEqual(delta.Len(), expected.Len()+int(uint64(length)/segmentSize)*16)
+				}
+			}
+		}
+	}
+}
+
+func TestWriteDeltaParallelErrors(t *testing.T) {
+	require := require.New(t)
+
+	data := make([]byte, 3*minSegmentSize)
+	sig, err := SignatureOptions{BlockSize: 512, StrongSize: 8}.WriteSignature(bytes.NewReader(data[:1000]), bytes.NewBuffer(nil))
+	require.NoError(err)
+
+	opts := DeltaOptions{Workers: 2}
+	err = opts.WriteDeltaAt(sig, bytes.NewReader(data), int64(len(data))+1, bytes.NewBuffer(nil))
+	require.ErrorIs(err, io.ErrUnexpectedEOF)
+
+	err = opts.WriteDeltaAt(sig, bytes.NewReader(data), int64(len(data)), errWriter{})
+	require.Error(err)
+}
+
+type errWriter struct{}
+
+func (errWriter) Write([]byte) (int, error) {
+	return 0, errors.New("write")
+}
+
+func BenchmarkWriteSignature(b *testing.B) {
+	data := make([]byte, 16*defaultChunkSize)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	for _, noDigest := range []bool{false, true} {
+		for _, workers := range []int{1, 2, 4, 8} {
+			opts := SignatureOptions{BlockSize: 2048, StrongSize: 16, StrongHash: BLAKE2b, Workers: workers, NoDigest: noDigest}
+			b.Run(fmt.Sprintf("workers=%d,nodigest=%t", workers, noDigest), func(b *testing.B) {
+				b.SetBytes(int64(len(data)))
+				for n := 0; n < b.N; n++ {
+					if _, err := opts.WriteSignatureAt(bytes.NewReader(data), int64(len(data)), io.Discard); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkWriteDelta(b *testing.B) {
+	data := make([]byte, 16*defaultChunkSize)
+	rand.New(rand.NewSource(1)).Read(data)
+	sig, err := SignatureOptions{BlockSize: 2048, StrongSize: 16}.WriteSignature(bytes.NewReader(data), io.Discard)
+	if err != nil {
+		b.Fatal(err)
+	}
+	// shift the new file, so every block is matched by rolling
+	newData := append([]byte("shifted"), data...)
+
+	for _, noDigest := range []bool{false, true} {
+		for _, workers := range []int{1, 2, 4, 8} {
+			opts := DeltaOptions{Workers: workers, NoDigest: noDigest}
+			b.Run(fmt.Sprintf("workers=%d,nodigest=%t", workers, noDigest), func(b *testing.B) {
+				b.SetBytes(int64(len(newData)))
+				for n := 0; n < b.N; n++ {
+					if err := opts.WriteDeltaAt(sig, bytes.NewReader(newData), int64(len(newData)), io.Discard); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
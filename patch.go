@@ -1,12 +1,143 @@
 package diff
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash"
 	"io"
+	"math"
 )
 
+type (
+	// PatchOptions configures how a new file is recreated.
+	// The zero value is ready to use.
+	PatchOptions struct {
+		// BufferSize is the size of the buffer data is copied through, 0 uses the io.Copy default
+		// (and 1MB chunks for PatchAt).
+		BufferSize int
+		// Workers is the number of goroutines copying basis ranges in PatchAt, 0 uses GOMAXPROCS.
+		Workers int
+		// VerifyBasis checks the basis against the digest recorded in the delta, before anything is written
+		// (or, for a forward-only basis, after the new file was recreated).
+		VerifyBasis bool
+		// VerifyNew makes PatchAt read the new file back through newWriterAt, which has to be an io.ReaderAt as well
+		// (e.g. an *os.File opened for reading and writing), and check it against the digest recorded in the delta.
+		// The other patch functions always check the new file, as it is written.
+		VerifyNew bool
+	}
+
+	// basisCopier copies blocks of the basis out to the new file.
+	// It returns io.EOF if the basis ends before the block does.
+	basisCopier interface {
+		copyBlock(w io.Writer, offset, size uint64, buf []byte) error
+	}
+
+	seekBasis struct {
+		io.ReadSeeker
+	}
+
+	readerAtBasis struct {
+		io.ReaderAt
+	}
+
+	// streamBasis reads the basis forward only, skipping data no copy needs.
+	streamBasis struct {
+		io.Reader
+		// pos is the number of basis bytes read so far.
+		pos uint64
+	}
+)
+
+// Patch recreates the new file from the basis and the delta, and writes it out to newWriter.
+// Truncated deltas, and basis files too short for the delta, are reported as io.ErrUnexpectedEOF.
+// If the delta records the digest of the new file, and the recreated file does not match it, ErrChecksumMismatch is returned.
 func Patch(basisReaderSeeker io.ReadSeeker, deltaReader io.Reader, newWriter io.Writer) error {
+	return PatchOptions{}.Patch(basisReaderSeeker, deltaReader, newWriter)
+}
+
+// PatchReaderAt is like Patch, but reads the basis with io.ReaderAt, so it is not seeked and can be shared.
+func PatchReaderAt(basisReaderAt io.ReaderAt, deltaReader io.Reader, newWriter io.Writer) error {
+	return PatchOptions{}.PatchReaderAt(basisReaderAt, deltaReader, newWriter)
+}
+
+// PatchStream is like Patch, but reads the basis forward only (e.g. from a pipe or an HTTP body).
+// Copy offsets must not go backwards (see DeltaOptions.InOrder), otherwise ErrOutOfOrder is returned.
+func PatchStream(basisReader io.Reader, deltaReader io.Reader, newWriter io.Writer) error {
+	return PatchOptions{}.PatchStream(basisReader, deltaReader, newWriter)
+}
+
+// Patch recreates the new file from the basis and the delta, and writes it out to newWriter.
+func (o PatchOptions) Patch(basisReaderSeeker io.ReadSeeker, deltaReader io.Reader, newWriter io.Writer) error {
+	dr, err := newDeltaReader(deltaReader)
+	if err != nil {
+		return err
+	}
+
+	if o.VerifyBasis {
+		if _, err = basisReaderSeeker.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if err = VerifyBasis(basisReaderSeeker, dr.header); err != nil {
+			return err
+		}
+	}
+	return o.patch(seekBasis{basisReaderSeeker}, dr, newWriter)
+}
+
+// PatchReaderAt recreates the new file from the basis (read with io.ReaderAt) and the delta, and writes it out to newWriter.
+func (o PatchOptions) PatchReaderAt(basisReaderAt io.ReaderAt, deltaReader io.Reader, newWriter io.Writer) error {
+	dr, err := newDeltaReader(deltaReader)
+	if err != nil {
+		return err
+	}
+
+	if o.VerifyBasis {
+		if err = VerifyBasis(io.NewSectionReader(basisReaderAt, 0, math.MaxInt64), dr.header); err != nil {
+			return err
+		}
+	}
+	return o.patch(readerAtBasis{basisReaderAt}, dr, newWriter)
+}
+
+// PatchStream recreates the new file from the forward-only basis and the delta, and writes it out to newWriter.
+// The basis is read only as far as the delta needs it, unless it has to be verified.
+func (o PatchOptions) PatchStream(basisReader io.Reader, deltaReader io.Reader, newWriter io.Writer) error {
+	dr, err := newDeltaReader(deltaReader)
+	if err != nil {
+		return err
+	}
+
+	var digest hash.Hash
+	if o.VerifyBasis && dr.header.BasisDigest != nil {
+		digest = dr.header.StrongHash.New()
+		basisReader = io.TeeReader(basisReader, digest)
+	}
+
+	err = o.patch(&streamBasis{Reader: basisReader}, dr, newWriter)
+	if digest != nil && (err == nil || errors.Is(err, ErrChecksumMismatch)) {
+		// the rest of the basis is not needed by the delta, but it is part of the digest
+		if _, err := io.Copy(io.Discard, basisReader); err != nil {
+			return err
+		}
+		if !bytes.Equal(dr.header.BasisDigest, digest.Sum(nil)) {
+			return fmt.Errorf("basis: %w", ErrChecksumMismatch)
+		}
+	}
+	return err
+}
+
+func (o PatchOptions) patch(basis basisCopier, dr *deltaReader, newWriter io.Writer) error {
+	var buf []byte
+	if o.BufferSize > 0 {
+		buf = make([]byte, o.BufferSize)
+	}
+
+	digest := dr.header.StrongHash.New()
+	newWriter = io.MultiWriter(newWriter, digest)
+
 	for {
-		i, err := ReadDeltaInstructionHeader(deltaReader)
+		i, err := dr.next()
 		if err != nil {
 			if err == io.EOF {
 				break
@@ -15,24 +146,86 @@ func Patch(basisReaderSeeker io.ReadSeeker, deltaReader io.Reader, newWriter io.
 		}
 
 		if i.From == FromOld {
-			if _, err = basisReaderSeeker.Seek(int64(i.Offset), io.SeekStart); err != nil {
-				return err
-			}
-			if _, err = io.CopyN(newWriter, basisReaderSeeker, int64(i.Size)); err != nil {
-				if err == io.EOF {
-					break
+			if err = basis.copyBlock(newWriter, i.Offset, i.Size, buf); err != nil {
+				if err != io.EOF {
+					return err
+				}
+				// legacy deltas may overstate the size of the final basis block
+				if !dr.header.legacy() {
+					return ErrBasisTooShort
 				}
-				return err
 			}
 		} else if i.From == FromNew {
-			if _, err = io.CopyN(newWriter, deltaReader, int64(i.Size)); err != nil {
-				if err == io.EOF {
-					break
-				}
+			if err = dr.copyData(newWriter, i.Size, buf); err != nil {
 				return err
 			}
 		}
 	}
 
+	if dr.digest != nil && !bytes.Equal(dr.digest, digest.Sum(nil)) {
+		return fmt.Errorf("recreated file: %w", ErrChecksumMismatch)
+	}
 	return nil
 }
+
+// VerifyBasis checks the basis against the digest recorded in the delta header.
+// Deltas without the basis digest are not verified.
+func VerifyBasis(basisReader io.Reader, header DeltaHeader) error {
+	if header.BasisDigest == nil {
+		return nil
+	}
+
+	digest := header.StrongHash.New()
+	if _, err := io.Copy(digest, basisReader); err != nil {
+		return err
+	}
+	if !bytes.Equal(header.BasisDigest, digest.Sum(nil)) {
+		return fmt.Errorf("basis: %w", ErrChecksumMismatch)
+	}
+	return nil
+}
+
+// copyN copies n bytes from src to dst like io.CopyN, through buf unless it is nil.
+func copyN(dst io.Writer, src io.Reader, n int64, buf []byte) (int64, error) {
+	if buf == nil {
+		return io.CopyN(dst, src, n)
+	}
+
+	written, err := io.CopyBuffer(dst, io.LimitReader(src, n), buf)
+	if written == n {
+		return n, nil
+	}
+	if written < n && err == nil {
+		// src stopped early
+		err = io.EOF
+	}
+	return written, err
+}
+
+func (b seekBasis) copyBlock(w io.Writer, offset, size uint64, buf []byte) error {
+	if _, err := b.Seek(int64(offset), io.SeekStart); err != nil {
+		return err
+	}
+	_, err := copyN(w, b, int64(size), buf)
+	return err
+}
+
+func (b readerAtBasis) copyBlock(w io.Writer, offset, size uint64, buf []byte) error {
+	_, err := copyN(w, io.NewSectionReader(b, int64(offset), int64(size)), int64(size), buf)
+	return err
+}
+
+func (b *streamBasis) copyBlock(w io.Writer, offset, size uint64, buf []byte) error {
+	if offset < b.pos {
+		return fmt.Errorf("copy from %d after basis offset %d: %w", offset, b.pos, ErrOutOfOrder)
+	}
+
+	n, err := io.CopyN(io.Discard, b.Reader, int64(offset-b.pos))
+	b.pos += uint64(n)
+	if err != nil {
+		return err
+	}
+	n, err = copyN(w, b.Reader, int64(size), buf)
+	b.pos += uint64(n)
+	return err
+}
@@ -2,8 +2,11 @@ package diff
 
 import (
 	"bytes"
+	"io"
 	"os"
+	"strings"
 	"testing"
+	"testing/iotest"
 
 	"github.com/stretchr/testify/require"
 )
@@ -85,3 +88,293 @@ func TestPatch(t *testing.T) {
 
 	require.EqualValues(newText, buf.String())
 }
+
+func TestPatchTruncated(t *testing.T) {
+	require := require.New(t)
+	setup(t)
+	defer tearDown(t)
+
+	info, err := deltaFile.Stat()
+	require.NoError(err)
+
+	buf := bytes.NewBuffer(nil)
+	err = Patch(basisFile, io.LimitReader(deltaFile, info.Size()-1), buf)
+	require.ErrorIs(err, io.ErrUnexpectedEOF)
+}
+
+func TestPatchLegacy(t *testing.T) {
+	require := require.New(t)
+
+	delta := bytes.NewBuffer(nil)
+	for _, i := range []*DeltaInstruction{
+		{DeltaInstructionHeader: DeltaInstructionHeader{From: FromNew, Offset: 0, Size: 11}, Data: []byte(newText[:11])},
+		{DeltaInstructionHeader: DeltaInstructionHeader{From: FromOld, Offset: 0, Size: 22}},
+		// legacy deltas overstate the size of the final block
+		{DeltaInstructionHeader: DeltaInstructionHeader{From: FromOld, Offset: 44, Size: 11}},
+	} {
+		require.NoError(i.writeTo(delta))
+	}
+
+	buf := bytes.NewBuffer(nil)
+	err := Patch(strings.NewReader(basisText), delta, buf)
+	require.NoError(err)
+
+	require.EqualValues(newText, buf.String())
+}
+
+func TestPatchChecksumMismatch(t *testing.T) {
+	require := require.New(t)
+
+	sig, err := WriteSignature(strings.NewReader(basisText), bytes.NewBuffer(nil), blockSize, strongSize)
+	require.NoError(err)
+
+	delta := bytes.NewBuffer(nil)
+	err = WriteDelta(sig, strings.NewReader(newText), delta)
+	require.NoError(err)
+
+	buf := bytes.NewBuffer(nil)
+	err = Patch(strings.NewReader(basisText), bytes.NewReader(delta.Bytes()), buf)
+	require.NoError(err)
+	require.EqualValues(newText, buf.String())
+
+	// same length, different content
+	basis := strings.ToUpper(basisText)
+	err = Patch(strings.NewReader(basis), bytes.NewReader(delta.Bytes()), bytes.NewBuffer(nil))
+	require.ErrorIs(err, ErrChecksumMismatch)
+}
+
+func TestVerifyBasis(t *testing.T) {
+	require := require.New(t)
+
+	sig, err := WriteSignature(strings.NewReader(basisText), bytes.NewBuffer(nil), blockSize, strongSize)
+	require.NoError(err)
+
+	delta := bytes.NewBuffer(nil)
+	err = WriteDelta(sig, strings.NewReader(newText), delta)
+	require.NoError(err)
+
+	header, err := ReadDeltaHeader(delta)
+	require.NoError(err)
+	require.NotEmpty(header.BasisDigest)
+
+	require.NoError(VerifyBasis(strings.NewReader(basisText), header))
+	require.ErrorIs(VerifyBasis(strings.NewReader(newText), header), ErrChecksumMismatch)
+}
+
+func TestPatchHash(t *testing.T) {
+	require := require.New(t)
+
+	for _, h := range []StrongHash{MD5, SHA1, SHA256, BLAKE2b} {
+		sig, err := SignatureOptions{BlockSize: blockSize, StrongSize: strongSize, StrongHash: h}.WriteSignature(strings.NewReader(basisText), bytes.NewBuffer(nil))
+		require.NoError(err)
+
+		delta := bytes.NewBuffer(nil)
+		err = WriteDelta(sig, strings.NewReader(newText), delta)
+		require.NoError(err)
+
+		header, err := ReadDeltaHeader(bytes.NewReader(delta.Bytes()))
+		require.NoError(err)
+		require.Equal(h, header.StrongHash)
+		require.NoError(VerifyBasis(strings.NewReader(basisText), header))
+
+		buf := bytes.NewBuffer(nil)
+		err = Patch(strings.NewReader(basisText), delta, buf)
+		require.NoError(err)
+		require.EqualValues(newText, buf.String())
+	}
+}
+
+func TestPatchWeakHash(t *testing.T) {
+	require := require.New(t)
+
+	for _, h := range []WeakHash{Rollsum, RabinKarp} {
+		sigBuffer := bytes.NewBuffer(nil)
+		_, err := SignatureOptions{BlockSize: blockSize, StrongSize: strongSize, WeakHash: h, StrongHash: MD5}.WriteSignature(strings.NewReader(basisText), sigBuffer)
+		require.NoError(err)
+
+		sig, err := ReadSignature(sigBuffer)
+		require.NoError(err)
+		require.Equal(h, sig.WeakHash)
+
+		delta := bytes.NewBuffer(nil)
+		err = WriteDelta(sig, strings.NewReader(newText), delta)
+		require.NoError(err)
+
+		instr, err := ReadDelta(bytes.NewReader(delta.Bytes()))
+		require.NoError(err)
+		require.Len(instr, 3)
+		require.Equal(FromNew, instr[0].From)
+		require.Equal(FromOld, instr[1].From)
+		require.Equal(FromOld, instr[2].From)
+
+		buf := bytes.NewBuffer(nil)
+		err = Patch(strings.NewReader(basisText), delta, buf)
+		require.NoError(err)
+		require.EqualValues(newText, buf.String())
+	}
+}
+
+func TestPatchUnmatchedTail(t *testing.T) {
+	require := require.New(t)
+
+	for _, text := range []string{``, `x`, `xyz`, `ala ma kota,xyz`, `ala ma kota,1234567890,kot ma ale,lal al ala,xyz`} {
+		sig, err := WriteSignature(strings.NewReader(basisText), bytes.NewBuffer(nil), blockSize, strongSize)
+		require.NoError(err)
+
+		delta := bytes.NewBuffer(nil)
+		err = WriteDelta(sig, strings.NewReader(text), delta)
+		require.NoError(err)
+
+		buf := bytes.NewBuffer(nil)
+		err = Patch(strings.NewReader(basisText), delta, buf)
+		require.NoError(err)
+		require.EqualValues(text, buf.String())
+	}
+}
+
+func TestPatchOptions(t *testing.T) {
+	require := require.New(t)
+
+	sig, err := WriteSignature(strings.NewReader(basisText), bytes.NewBuffer(nil), blockSize, strongSize)
+	require.NoError(err)
+
+	delta := bytes.NewBuffer(nil)
+	err = WriteDelta(sig, strings.NewReader(newText), delta)
+	require.NoError(err)
+
+	for _, bufferSize := range []int{0, 1, 7, 4096} {
+		opts := PatchOptions{BufferSize: bufferSize, VerifyBasis: true}
+		buf := bytes.NewBuffer(nil)
+		err = opts.Patch(strings.NewReader(basisText), bytes.NewReader(delta.Bytes()), buf)
+		require.NoError(err)
+		require.EqualValues(newText, buf.String())
+
+		// basis too short
+		err = opts.Patch(strings.NewReader(basisText[:len(basisText)-1]), bytes.NewReader(delta.Bytes()), bytes.NewBuffer(nil))
+		require.Error(err)
+
+		// delta truncated
+		err = opts.Patch(strings.NewReader(basisText), bytes.NewReader(delta.Bytes()[:delta.Len()-1]), bytes.NewBuffer(nil))
+		require.ErrorIs(err, io.ErrUnexpectedEOF)
+	}
+
+	// the basis is verified before anything is written
+	buf := bytes.NewBuffer(nil)
+	err = PatchOptions{VerifyBasis: true}.Patch(strings.NewReader(strings.ToUpper(basisText)), bytes.NewReader(delta.Bytes()), buf)
+	require.ErrorIs(err, ErrChecksumMismatch)
+	require.Zero(buf.Len())
+}
+
+func TestOptionsConcurrent(t *testing.T) {
+	for _, opts := range []SignatureOptions{
+		{BlockSize: 3, StrongSize: 4, WeakHash: Rollsum, StrongHash: MD5},
+		{BlockSize: 5, StrongSize: 16, WeakHash: RabinKarp, StrongHash: SHA1},
+		{BlockSize: 7, StrongSize: 32, WeakHash: Rollsum, StrongHash: SHA256},
+		{BlockSize: 11, StrongSize: 8, WeakHash: RabinKarp, StrongHash: BLAKE2b},
+		{Format: Rdiff, BlockSize: 13, StrongSize: 8, WeakHash: RabinKarp, StrongHash: MD4},
+	} {
+		t.Run(opts.StrongHash.String(), func(t *testing.T) {
+			t.Parallel()
+			require := require.New(t)
+
+			for n := 0; n < 50; n++ {
+				sigBuffer := bytes.NewBuffer(nil)
+				_, err := opts.WriteSignature(strings.NewReader(basisText), sigBuffer)
+				require.NoError(err)
+				sig, err := ReadSignature(sigBuffer)
+				require.NoError(err)
+				require.Equal(opts.StrongHash, sig.StrongHash)
+
+				delta := bytes.NewBuffer(nil)
+				err = DeltaOptions{Format: opts.Format}.WriteDelta(sig, strings.NewReader(newText), delta)
+				require.NoError(err)
+
+				buf := bytes.NewBuffer(nil)
+				err = PatchOptions{BufferSize: n + 1}.Patch(strings.NewReader(basisText), delta, buf)
+				require.NoError(err)
+				require.EqualValues(newText, buf.String())
+			}
+		})
+	}
+}
+
+func TestPatchReaderAt(t *testing.T) {
+	require := require.New(t)
+
+	sig, err := WriteSignature(strings.NewReader(basisText), bytes.NewBuffer(nil), blockSize, strongSize)
+	require.NoError(err)
+
+	delta := bytes.NewBuffer(nil)
+	err = WriteDelta(sig, strings.NewReader(newText), delta)
+	require.NoError(err)
+
+	buf := bytes.NewBuffer(nil)
+	err = PatchReaderAt(strings.NewReader(basisText), bytes.NewReader(delta.Bytes()), buf)
+	require.NoError(err)
+	require.EqualValues(newText, buf.String())
+
+	for _, bufferSize := range []int{0, 3} {
+		opts := PatchOptions{BufferSize: bufferSize, VerifyBasis: true}
+		buf.Reset()
+		err = opts.PatchReaderAt(strings.NewReader(basisText), bytes.NewReader(delta.Bytes()), buf)
+		require.NoError(err)
+		require.EqualValues(newText, buf.String())
+
+		err = opts.PatchReaderAt(strings.NewReader(strings.ToUpper(basisText)), bytes.NewReader(delta.Bytes()), bytes.NewBuffer(nil))
+		require.ErrorIs(err, ErrChecksumMismatch)
+	}
+
+	err = PatchReaderAt(strings.NewReader(basisText[:len(basisText)-1]), bytes.NewReader(delta.Bytes()), bytes.NewBuffer(nil))
+	require.ErrorIs(err, io.ErrUnexpectedEOF)
+}
+
+func TestPatchStream(t *testing.T) {
+	require := require.New(t)
+
+	sig, err := WriteSignature(strings.NewReader(basisText), bytes.NewBuffer(nil), blockSize, strongSize)
+	require.NoError(err)
+
+	// copies basis blocks backwards
+	reordered := basisText[22:33] + basisText[:11]
+	delta := bytes.NewBuffer(nil)
+	err = WriteDelta(sig, strings.NewReader(reordered), delta)
+	require.NoError(err)
+	err = PatchStream(strings.NewReader(basisText), bytes.NewReader(delta.Bytes()), bytes.NewBuffer(nil))
+	require.ErrorIs(err, ErrOutOfOrder)
+
+	delta.Reset()
+	err = DeltaOptions{InOrder: true}.WriteDelta(sig, strings.NewReader(reordered), delta)
+	require.NoError(err)
+	buf := bytes.NewBuffer(nil)
+	err = PatchStream(strings.NewReader(basisText), bytes.NewReader(delta.Bytes()), buf)
+	require.NoError(err)
+	require.EqualValues(reordered, buf.String())
+
+	delta.Reset()
+	err = WriteDelta(sig, strings.NewReader(newText), delta)
+	require.NoError(err)
+
+	for _, bufferSize := range []int{0, 1, 5} {
+		opts := PatchOptions{BufferSize: bufferSize, VerifyBasis: true}
+
+		// the basis comes from a pipe
+		pr, pw := io.Pipe()
+		go func() {
+			_, err := io.Copy(pw, iotest.OneByteReader(strings.NewReader(basisText)))
+			pw.CloseWithError(err)
+		}()
+		buf.Reset()
+		err = opts.PatchStream(pr, bytes.NewReader(delta.Bytes()), buf)
+		require.NoError(err)
+		require.EqualValues(newText, buf.String())
+
+		// the basis is verified after the new file was recreated
+		basis := basisText[:len(basisText)-1] + "X"
+		err = opts.PatchStream(strings.NewReader(basis), bytes.NewReader(delta.Bytes()), bytes.NewBuffer(nil))
+		require.ErrorIs(err, ErrChecksumMismatch)
+		require.Contains(err.Error(), "basis")
+	}
+
+	err = PatchStream(strings.NewReader(basisText[:20]), bytes.NewReader(delta.Bytes()), bytes.NewBuffer(nil))
+	require.ErrorIs(err, io.ErrUnexpectedEOF)
+}
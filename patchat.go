@@ -0,0 +1,159 @@
+package diff
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"runtime"
+	"sync"
+)
+
+// defaultChunkSize is the largest basis range a PatchAt worker copies at once, unless PatchOptions.BufferSize is set.
+const defaultChunkSize = 1024 * 1024
+
+// copyJob copies a range of the basis to its offset in the new file.
+type copyJob struct {
+	from, to uint64
+	size     int
+}
+
+// PatchAt recreates the new file from the basis and the delta, and writes it out to newWriterAt.
+// Basis ranges are copied concurrently, see PatchOptions.PatchAt.
+func PatchAt(basisReaderAt io.ReaderAt, deltaReader io.Reader, newWriterAt io.WriterAt) error {
+	return PatchOptions{}.PatchAt(basisReaderAt, deltaReader, newWriterAt)
+}
+
+// PatchAt recreates the new file from the basis and the delta, and writes it out to newWriterAt.
+// The delta is scanned once: literal data is written as it is read, and basis ranges (split in chunks of BufferSize bytes)
+// are copied to their offsets in the new file by a pool of Workers goroutines, so the new file is written out of order.
+// The new file is only checked against the digest recorded in the delta with VerifyNew, by reading it back.
+func (o PatchOptions) PatchAt(basisReaderAt io.ReaderAt, deltaReader io.Reader, newWriterAt io.WriterAt) error {
+	newReaderAt, ok := newWriterAt.(io.ReaderAt)
+	if o.VerifyNew && !ok {
+		return fmt.Errorf("%w: VerifyNew needs a new file which is an io.ReaderAt", ErrInvalidOptions)
+	}
+
+	dr, err := newDeltaReader(deltaReader)
+	if err != nil {
+		return err
+	}
+
+	if o.VerifyBasis {
+		if err = VerifyBasis(io.NewSectionReader(basisReaderAt, 0, math.MaxInt64), dr.header); err != nil {
+			return err
+		}
+	}
+	if dr.header.legacy() {
+		// legacy deltas may overstate the size of the final basis block, so offsets in the new file
+		// are only known once the basis was read
+		return o.patch(readerAtBasis{basisReaderAt}, dr, io.NewOffsetWriter(newWriterAt, 0))
+	}
+
+	chunkSize := o.BufferSize
+	if chunkSize <= 0 {
+		chunkSize = defaultChunkSize
+	}
+	workers := o.Workers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+
+	var (
+		wg      sync.WaitGroup
+		once    sync.Once
+		copyErr error
+	)
+	jobs := make(chan copyJob)
+	done := make(chan struct{})
+	fail := func(err error) {
+		once.Do(func() {
+			copyErr = err
+			close(done)
+		})
+	}
+	for n := 0; n < workers; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			buf := make([]byte, chunkSize)
+			for job := range jobs {
+				select {
+				case <-done:
+					// drain
+					continue
+				default:
+				}
+				if err := job.copy(basisReaderAt, newWriterAt, buf); err != nil {
+					fail(err)
+				}
+			}
+		}()
+	}
+
+	length, err := scanAt(dr, newWriterAt, jobs, done, chunkSize)
+	close(jobs)
+	wg.Wait()
+	if copyErr != nil {
+		return copyErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if o.VerifyNew && dr.digest != nil {
+		digest := dr.header.StrongHash.New()
+		if _, err = io.Copy(digest, io.NewSectionReader(newReaderAt, 0, int64(length))); err != nil {
+			return err
+		}
+		if !bytes.Equal(dr.digest, digest.Sum(nil)) {
+			return fmt.Errorf("recreated file: %w", ErrChecksumMismatch)
+		}
+	}
+	return nil
+}
+
+// scanAt reads all instructions from dr, writes literal data out to w and sends basis ranges to jobs, until done is closed.
+// It returns the length of the new file.
+func scanAt(dr *deltaReader, w io.WriterAt, jobs chan<- copyJob, done <-chan struct{}, chunkSize int) (uint64, error) {
+	buf := make([]byte, chunkSize)
+	offset := uint64(0)
+	for {
+		i, err := dr.next()
+		if err != nil {
+			if err == io.EOF {
+				return offset, nil
+			}
+			return offset, err
+		}
+
+		if i.From == FromOld {
+			for n := uint64(0); n < i.Size; n += uint64(chunkSize) {
+				job := copyJob{from: i.Offset + n, to: offset + n, size: int(min(uint64(chunkSize), i.Size-n))}
+				select {
+				case jobs <- job:
+				case <-done:
+					return offset, nil
+				}
+			}
+		} else if i.From == FromNew {
+			if err = dr.copyData(io.NewOffsetWriter(w, int64(offset)), i.Size, buf); err != nil {
+				return offset, err
+			}
+		}
+		offset += i.Size
+	}
+}
+
+func (job copyJob) copy(r io.ReaderAt, w io.WriterAt, buf []byte) error {
+	buf = buf[:job.size]
+	if n, err := r.ReadAt(buf, int64(job.from)); n < len(buf) {
+		if err == nil || err == io.EOF {
+			return ErrBasisTooShort
+		}
+		return err
+	}
+	_, err := w.WriteAt(buf, int64(job.to))
+	return err
+}
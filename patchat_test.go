@@ -0,0 +1,169 @@
+package diff
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// memFile is an in-memory io.WriterAt and io.ReaderAt (and InPlaceFile).
+type memFile struct {
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if end := int(off) + len(p); end > len(f.buf) {
+		f.buf = append(f.buf, make([]byte, end-len(f.buf))...)
+	}
+	return copy(f.buf[off:], p), nil
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return bytes.NewReader(f.buf).ReadAt(p, off)
+}
+
+func (f *memFile) Truncate(size int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if int(size) < len(f.buf) {
+		f.buf = f.buf[:size]
+	} else {
+		f.buf = append(f.buf, make([]byte, int(size)-len(f.buf))...)
+	}
+	return nil
+}
+
+// writerAt hides io.ReaderAt.
+type writerAt struct {
+	io.WriterAt
+}
+
+func TestPatchAt(t *testing.T) {
+	require := require.New(t)
+
+	rnd := rand.New(rand.NewSource(1))
+	basis := make([]byte, 256*1024)
+	rnd.Read(basis)
+	// move, duplicate and insert data
+	newData := append([]byte{}, basis[100000:]...)
+	newData = append(newData, []byte("hello")...)
+	newData = append(newData, basis[:150000]...)
+	newData = append(newData, basis[5000:9000]...)
+
+	sig, err := WriteSignature(bytes.NewReader(basis), bytes.NewBuffer(nil), 512, 8)
+	require.NoError(err)
+
+	for _, opts := range []DeltaOptions{{}, {Encoding: CompactEncoding, Compression: FlateCompression}, {Format: Rdiff}} {
+		delta := bytes.NewBuffer(nil)
+		err = opts.WriteDelta(sig, bytes.NewReader(newData), delta)
+		require.NoError(err)
+
+		for _, opts := range []PatchOptions{{}, {Workers: 1}, {Workers: 3, BufferSize: 1000}, {Workers: 16, BufferSize: 1, VerifyBasis: true, VerifyNew: true}} {
+			f := &memFile{}
+			err = opts.PatchAt(bytes.NewReader(basis), bytes.NewReader(delta.Bytes()), f)
+			require.NoError(err)
+			require.Equal(newData, f.buf)
+		}
+	}
+}
+
+func TestPatchAtErrors(t *testing.T) {
+	require := require.New(t)
+
+	sig, err := WriteSignature(strings.NewReader(basisText), bytes.NewBuffer(nil), blockSize, strongSize)
+	require.NoError(err)
+
+	delta := bytes.NewBuffer(nil)
+	err = WriteDelta(sig, strings.NewReader(newText), delta)
+	require.NoError(err)
+
+	// same length, different content
+	basis := strings.ToUpper(basisText)
+	err = PatchOptions{VerifyNew: true}.PatchAt(strings.NewReader(basis), bytes.NewReader(delta.Bytes()), &memFile{})
+	require.ErrorIs(err, ErrChecksumMismatch)
+	err = PatchOptions{VerifyBasis: true}.PatchAt(strings.NewReader(basis), bytes.NewReader(delta.Bytes()), &memFile{})
+	require.ErrorIs(err, ErrChecksumMismatch)
+	// the new file is not read back, unless asked to
+	err = PatchAt(strings.NewReader(basis), bytes.NewReader(delta.Bytes()), &memFile{})
+	require.NoError(err)
+	err = PatchOptions{VerifyNew: true}.PatchAt(strings.NewReader(basisText), bytes.NewReader(delta.Bytes()), writerAt{&memFile{}})
+	require.ErrorIs(err, ErrInvalidOptions)
+
+	for _, workers := range []int{1, 4} {
+		opts := PatchOptions{Workers: workers, BufferSize: 2}
+		err = opts.PatchAt(strings.NewReader(basisText[:len(basisText)-1]), bytes.NewReader(delta.Bytes()), &memFile{})
+		require.ErrorIs(err, io.ErrUnexpectedEOF)
+
+		err = opts.PatchAt(strings.NewReader(basisText), bytes.NewReader(delta.Bytes()[:delta.Len()-1]), &memFile{})
+		require.ErrorIs(err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestPatchAtLegacy(t *testing.T) {
+	require := require.New(t)
+
+	delta := bytes.NewBuffer(nil)
+	for _, i := range []*DeltaInstruction{
+		{DeltaInstructionHeader: DeltaInstructionHeader{From: FromNew, Offset: 0, Size: 11}, Data: []byte(newText[:11])},
+		{DeltaInstructionHeader: DeltaInstructionHeader{From: FromOld, Offset: 0, Size: 22}},
+		// legacy deltas overstate the size of the final block
+		{DeltaInstructionHeader: DeltaInstructionHeader{From: FromOld, Offset: 44, Size: 11}},
+	} {
+		require.NoError(i.writeTo(delta))
+	}
+
+	f := &memFile{}
+	err := PatchAt(strings.NewReader(basisText), delta, f)
+	require.NoError(err)
+	require.EqualValues(newText, string(f.buf))
+}
+
+func TestPatchAtFile(t *testing.T) {
+	require := require.New(t)
+	setup(t)
+	defer tearDown(t)
+
+	recreatedFile, err := os.CreateTemp("", "recreated")
+	require.NoError(err)
+	defer os.Remove(recreatedFile.Name())
+	defer recreatedFile.Close()
+
+	err = PatchAt(basisFile, deltaFile, recreatedFile)
+	require.NoError(err)
+
+	b, err := os.ReadFile(recreatedFile.Name())
+	require.NoError(err)
+	require.EqualValues(newText, string(b))
+
+	// a write-only file is not read back
+	sig, err := WriteSignature(strings.NewReader(basisText), bytes.NewBuffer(nil), blockSize, strongSize)
+	require.NoError(err)
+	delta := bytes.NewBuffer(nil)
+	require.NoError(WriteDelta(sig, strings.NewReader(newText), delta))
+
+	writeOnlyFile, err := os.OpenFile(recreatedFile.Name(), os.O_WRONLY|os.O_TRUNC, 0)
+	require.NoError(err)
+	defer writeOnlyFile.Close()
+	err = PatchAt(strings.NewReader(basisText), bytes.NewReader(delta.Bytes()), writeOnlyFile)
+	require.NoError(err)
+	err = PatchOptions{VerifyNew: true}.PatchAt(strings.NewReader(basisText), bytes.NewReader(delta.Bytes()), recreatedFile)
+	require.NoError(err)
+
+	b, err = os.ReadFile(recreatedFile.Name())
+	require.NoError(err)
+	require.EqualValues(newText, string(b))
+}
@@ -0,0 +1,66 @@
+package diff
+
+// RabinKarp rolling hash constants were taken from librsync:
+// https://github.com/librsync/librsync/blob/master/src/rabinkarp.h
+const (
+	rabinKarpSeed = uint32(1)
+	rabinKarpMult = uint32(0x08104225)
+	// rabinKarpAdj is rabinKarpMult - 1, it accounts for the seed when a byte is rolled out.
+	rabinKarpAdj = uint32(0x08104224)
+)
+
+// rabinKarp32 returns the RabinKarp hash of p.
+func rabinKarp32(p []byte) uint32 {
+	h := rabinKarpSeed
+	for _, b := range p {
+		h = h*rabinKarpMult + uint32(b)
+	}
+	return h
+}
+
+// rabinKarp is the rolling version of rabinKarp32.
+type rabinKarp struct {
+	hash uint32
+	// mult is rabinKarpMult^count, where count is the length of the window.
+	mult uint32
+}
+
+func newRabinKarp() *rabinKarp {
+	rk := &rabinKarp{}
+	rk.reset()
+	return rk
+}
+
+func (rk *rabinKarp) reset() {
+	rk.hash = rabinKarpSeed
+	rk.mult = 1
+}
+
+func (rk *rabinKarp) rollin(p []byte) {
+	h, mult := rk.hash, rk.mult
+	for _, in := range p {
+		h = h*rabinKarpMult + uint32(in)
+		mult *= rabinKarpMult
+	}
+	rk.hash, rk.mult = h, mult
+}
+
+func (rk *rabinKarp) rotate(out, in byte) {
+	rk.hash = rk.hash*rabinKarpMult + uint32(in) - rk.mult*(uint32(out)+rabinKarpAdj)
+}
+
+func (rk *rabinKarp) roll(p []byte, size int, filter *weakFilter) (int, bool) {
+	h, mult := rk.hash, rk.mult
+	n := 0
+	ok := filter.has(h)
+	for ; !ok && n+size < len(p); n++ {
+		h = h*rabinKarpMult + uint32(p[n+size]) - mult*(uint32(p[n])+rabinKarpAdj)
+		ok = filter.has(h)
+	}
+	rk.hash = h
+	return n, ok
+}
+
+func (rk *rabinKarp) sum() uint32 {
+	return rk.hash
+}
@@ -0,0 +1,13 @@
+package diff
+
+import "testing"
+
+func TestRabinKarp32(t *testing.T) {
+	testRollingHash(t, RabinKarp)
+
+	rh := RabinKarp.newRollingHash()
+	rh.rollin([]byte("a"))
+	if c1, c2 := rabinKarp32([]byte("a")), rh.sum(); c1 != c2 {
+		t.Fatalf("expected: %d, got: %d", c1, c2)
+	}
+}
@@ -0,0 +1,245 @@
+package diff
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// librsync magic numbers, see:
+// https://github.com/librsync/librsync/blob/master/src/librsync.h
+const (
+	rdiffMD4SigMagic      = uint32(0x72730136)
+	rdiffBLAKE2SigMagic   = uint32(0x72730137)
+	rdiffRkMD4SigMagic    = uint32(0x72730146)
+	rdiffRkBLAKE2SigMagic = uint32(0x72730147)
+	rdiffDeltaMagic       = uint32(0x72730236)
+)
+
+// librsync delta commands, see:
+// https://github.com/librsync/librsync/blob/master/src/prototab.h
+const (
+	rdiffOpEnd = byte(0x00)
+	// rdiffOpLiteral1 .. rdiffOpLiteral64 carry the literal length in the command itself.
+	rdiffOpLiteral1  = byte(0x01)
+	rdiffOpLiteral64 = byte(0x40)
+	// rdiffOpLiteralN1 .. rdiffOpLiteralN8 are followed by a 1, 2, 4 or 8 byte literal length.
+	rdiffOpLiteralN1 = byte(0x41)
+	rdiffOpLiteralN8 = byte(0x44)
+	// rdiffOpCopyN1N1 .. rdiffOpCopyN8N8 are followed by a 1, 2, 4 or 8 byte offset and length.
+	rdiffOpCopyN1N1 = byte(0x45)
+	rdiffOpCopyN8N8 = byte(0x54)
+)
+
+// rdiffByteOrder is the (fixed) byte order of the librsync formats.
+var rdiffByteOrder = binary.BigEndian
+
+// rdiffWriter writes instructions as librsync delta commands.
+type rdiffWriter struct {
+	io.Writer
+}
+
+func writeRdiffSignature(sum checksummer, signatureWriter io.Writer, o SignatureOptions) (*Signature, error) {
+	magic, ok := rdiffSignatureMagic(o.WeakHash, o.StrongHash)
+	if !ok {
+		return nil, fmt.Errorf("%w: unsupported by librsync: %v/%v", ErrInvalidOptions, o.WeakHash, o.StrongHash)
+	}
+
+	header := signatureHeader{
+		Format:     Rdiff,
+		WeakHash:   o.WeakHash,
+		StrongHash: o.StrongHash,
+		BlockSize:  o.BlockSize,
+		StrongSize: o.StrongSize,
+	}
+	var b [4 + 4 + 4]byte
+	rdiffByteOrder.PutUint32(b[:4], magic)
+	rdiffByteOrder.PutUint32(b[4:8], o.BlockSize)
+	rdiffByteOrder.PutUint32(b[8:], uint32(o.StrongSize))
+	if _, err := signatureWriter.Write(b[:]); err != nil {
+		return nil, err
+	}
+
+	checksum, _, err := sum(signatureWriter, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Signature{header, checksum}, nil
+}
+
+func writeRdiffDelta(scan deltaScanner, deltaWriter io.Writer) error {
+	var b [4]byte
+	rdiffByteOrder.PutUint32(b[:], rdiffDeltaMagic)
+	if _, err := deltaWriter.Write(b[:]); err != nil {
+		return err
+	}
+
+	w := rdiffWriter{deltaWriter}
+	length, err := scan(w, nil)
+	if err != nil {
+		return err
+	}
+	return w.writeEnd(length)
+}
+
+func rdiffSignatureMagic(weakHash WeakHash, strongHash StrongHash) (uint32, bool) {
+	switch {
+	case weakHash == Rollsum && strongHash == MD4:
+		return rdiffMD4SigMagic, true
+	case weakHash == Rollsum && strongHash == BLAKE2b:
+		return rdiffBLAKE2SigMagic, true
+	case weakHash == RabinKarp && strongHash == MD4:
+		return rdiffRkMD4SigMagic, true
+	case weakHash == RabinKarp && strongHash == BLAKE2b:
+		return rdiffRkBLAKE2SigMagic, true
+	}
+	return 0, false
+}
+
+func rdiffSignatureHashes(magic uint32) (WeakHash, StrongHash, bool) {
+	switch magic {
+	case rdiffMD4SigMagic:
+		return Rollsum, MD4, true
+	case rdiffBLAKE2SigMagic:
+		return Rollsum, BLAKE2b, true
+	case rdiffRkMD4SigMagic:
+		return RabinKarp, MD4, true
+	case rdiffRkBLAKE2SigMagic:
+		return RabinKarp, BLAKE2b, true
+	}
+	return 0, 0, false
+}
+
+// readRdiffSignatureHeader reads the rest of the librsync signature header, after the magic.
+func readRdiffSignatureHeader(r io.Reader, weakHash WeakHash, strongHash StrongHash) (header signatureHeader, err error) {
+	var b [4 + 4]byte
+	if _, err = io.ReadFull(r, b[:]); err != nil {
+		return header, noEOF(err)
+	}
+
+	strongSize := rdiffByteOrder.Uint32(b[4:])
+	if strongSize > 0xff {
+		return header, fmt.Errorf("%w: strong size %d", ErrInvalidSignature, strongSize)
+	}
+	header = signatureHeader{
+		Format:     Rdiff,
+		WeakHash:   weakHash,
+		StrongHash: strongHash,
+		BlockSize:  rdiffByteOrder.Uint32(b[:4]),
+		StrongSize: byte(strongSize),
+	}
+	err = header.validate()
+	return
+}
+
+func (w rdiffWriter) writeInstruction(i *DeltaInstruction) error {
+	var b [1 + 8 + 8]byte
+	n := 1
+	switch i.From {
+	case FromNew:
+		if i.Size <= uint64(rdiffOpLiteral64) {
+			b[0] = byte(i.Size)
+		} else {
+			l := rdiffIntLen(i.Size)
+			b[0] = rdiffOpLiteralN1 + rdiffIntLenCode(l)
+			n += rdiffPutInt(b[n:], i.Size, l)
+		}
+		if _, err := w.Write(b[:n]); err != nil {
+			return err
+		}
+		_, err := w.Write(i.Data)
+		return err
+
+	case FromOld:
+		ol, sl := rdiffIntLen(i.Offset), rdiffIntLen(i.Size)
+		b[0] = rdiffOpCopyN1N1 + 4*rdiffIntLenCode(ol) + rdiffIntLenCode(sl)
+		n += rdiffPutInt(b[n:], i.Offset, ol)
+		n += rdiffPutInt(b[n:], i.Size, sl)
+		_, err := w.Write(b[:n])
+		return err
+	}
+	return fmt.Errorf("invalid delta instruction: %#x", i.From)
+}
+
+// writeEnd writes the END command, librsync deltas do not record the length of the recreated file.
+func (w rdiffWriter) writeEnd(uint64) error {
+	_, err := w.Write([]byte{rdiffOpEnd})
+	return err
+}
+
+// readRdiffCommand reads a single librsync delta command, the END command is returned as the FromEnd trailer.
+func readRdiffCommand(r io.Reader) (header DeltaInstructionHeader, err error) {
+	var op [1]byte
+	if _, err = io.ReadFull(r, op[:]); err != nil {
+		return
+	}
+
+	switch {
+	case op[0] == rdiffOpEnd:
+		header.From = FromEnd
+	case op[0] <= rdiffOpLiteral64:
+		header.From = FromNew
+		header.Size = uint64(op[0])
+	case op[0] <= rdiffOpLiteralN8:
+		header.From = FromNew
+		header.Size, err = rdiffReadInt(r, 1<<(op[0]-rdiffOpLiteralN1))
+	case op[0] <= rdiffOpCopyN8N8:
+		code := op[0] - rdiffOpCopyN1N1
+		header.From = FromOld
+		if header.Offset, err = rdiffReadInt(r, 1<<(code/4)); err != nil {
+			return
+		}
+		header.Size, err = rdiffReadInt(r, 1<<(code%4))
+	default:
+		err = fmt.Errorf("invalid rdiff command: %#x", op[0])
+	}
+	return
+}
+
+// rdiffIntLen returns the smallest of 1, 2, 4 or 8 bytes v fits in.
+func rdiffIntLen(v uint64) int {
+	switch {
+	case v <= 0xff:
+		return 1
+	case v <= 0xffff:
+		return 2
+	case v <= 0xffffffff:
+		return 4
+	}
+	return 8
+}
+
+// rdiffIntLenCode returns the position of l in 1, 2, 4, 8.
+func rdiffIntLenCode(l int) byte {
+	switch l {
+	case 1:
+		return 0
+	case 2:
+		return 1
+	case 4:
+		return 2
+	}
+	return 3
+}
+
+func rdiffPutInt(b []byte, v uint64, l int) int {
+	switch l {
+	case 1:
+		b[0] = byte(v)
+	case 2:
+		rdiffByteOrder.PutUint16(b, uint16(v))
+	case 4:
+		rdiffByteOrder.PutUint32(b, uint32(v))
+	default:
+		rdiffByteOrder.PutUint64(b, v)
+	}
+	return l
+}
+
+func rdiffReadInt(r io.Reader, l int) (uint64, error) {
+	var b [8]byte
+	if _, err := io.ReadFull(r, b[8-l:]); err != nil {
+		return 0, noEOF(err)
+	}
+	return rdiffByteOrder.Uint64(b[:]), nil
+}
@@ -0,0 +1,158 @@
+package diff
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/md4"
+)
+
+func TestRdiffSignature(t *testing.T) {
+	require := require.New(t)
+
+	const (
+		blockSize  = 4
+		strongSize = 8
+
+		text = `abcdefghij`
+	)
+
+	rw := bytes.NewBuffer(nil)
+	sig1, err := SignatureOptions{Format: Rdiff, BlockSize: blockSize, StrongSize: strongSize, WeakHash: Rollsum, StrongHash: MD4}.WriteSignature(strings.NewReader(text), rw)
+	require.NoError(err)
+
+	// {magic: 4 bytes, block size: 4 bytes, strong size: 4 bytes}
+	expected := []byte{0x72, 0x73, 0x01, 0x36, 0x0, 0x0, 0x0, blockSize, 0x0, 0x0, 0x0, strongSize}
+	// {weak checksum: 4 bytes, strong checksum: 8 bytes}
+	for i := 0; i < len(text); i += blockSize {
+		block := []byte(text[i:min(i+blockSize, len(text))])
+		weak := checksum32(block)
+		expected = append(expected, byte(weak>>24), byte(weak>>16), byte(weak>>8), byte(weak))
+		h := md4.New()
+		h.Write(block)
+		expected = append(expected, h.Sum(nil)[:strongSize]...)
+	}
+	require.Equal(expected, rw.Bytes())
+
+	sig2, err := ReadSignature(rw)
+	require.NoError(err)
+	require.EqualValues(sig1, sig2)
+	require.Equal(Rdiff, sig2.Format)
+}
+
+func TestRdiffSignatureMagic(t *testing.T) {
+	require := require.New(t)
+
+	for magic, hashes := range map[uint32][2]byte{
+		0x72730136: {byte(Rollsum), byte(MD4)},
+		0x72730137: {byte(Rollsum), byte(BLAKE2b)},
+		0x72730146: {byte(RabinKarp), byte(MD4)},
+		0x72730147: {byte(RabinKarp), byte(BLAKE2b)},
+	} {
+		weakHash, strongHash := WeakHash(hashes[0]), StrongHash(hashes[1])
+
+		rw := bytes.NewBuffer(nil)
+		sig1, err := SignatureOptions{Format: Rdiff, BlockSize: blockSize, StrongSize: strongSize, WeakHash: weakHash, StrongHash: strongHash}.WriteSignature(strings.NewReader(basisText), rw)
+		require.NoError(err)
+		require.Equal(magic, byteOrder.Uint32(rw.Bytes()[:4]))
+
+		sig2, err := ReadSignature(rw)
+		require.NoError(err)
+		require.EqualValues(sig1, sig2)
+	}
+
+	_, err := SignatureOptions{Format: Rdiff, BlockSize: blockSize, StrongSize: strongSize, WeakHash: Rollsum, StrongHash: MD5}.WriteSignature(strings.NewReader(basisText), bytes.NewBuffer(nil))
+	require.Error(err)
+}
+
+func TestRdiffDelta(t *testing.T) {
+	require := require.New(t)
+
+	sig, err := WriteSignature(strings.NewReader(basisText), bytes.NewBuffer(nil), blockSize, strongSize)
+	require.NoError(err)
+
+	delta := bytes.NewBuffer(nil)
+	err = DeltaOptions{Format: Rdiff}.WriteDelta(sig, strings.NewReader(newText), delta)
+	require.NoError(err)
+
+	expected := []byte{0x72, 0x73, 0x02, 0x36}
+	// LITERAL_11
+	expected = append(expected, 0x0b)
+	expected = append(expected, newText[:11]...)
+	// COPY_N1_N1
+	expected = append(expected, 0x45, 0x0, 0x16)
+	expected = append(expected, 0x45, 0x2c, 0x06)
+	// END
+	expected = append(expected, 0x0)
+	require.Equal(expected, delta.Bytes())
+
+	header, err := ReadDeltaHeader(bytes.NewReader(delta.Bytes()))
+	require.NoError(err)
+	require.Equal(Rdiff, header.Format)
+
+	instr, err := ReadDelta(bytes.NewReader(delta.Bytes()))
+	require.NoError(err)
+	require.Len(instr, 3)
+	require.EqualValues(DeltaInstructionHeader{From: FromNew, Offset: 0, Size: 11}, instr[0].DeltaInstructionHeader)
+	require.EqualValues(newText[:11], instr[0].Data)
+	require.EqualValues(DeltaInstructionHeader{From: FromOld, Offset: 0, Size: 22}, instr[1].DeltaInstructionHeader)
+	require.EqualValues(DeltaInstructionHeader{From: FromOld, Offset: 44, Size: 6}, instr[2].DeltaInstructionHeader)
+
+	buf := bytes.NewBuffer(nil)
+	err = Patch(strings.NewReader(basisText), delta, buf)
+	require.NoError(err)
+	require.EqualValues(newText, buf.String())
+}
+
+func TestRdiffCommand(t *testing.T) {
+	require := require.New(t)
+
+	for _, i := range []*DeltaInstruction{
+		{DeltaInstructionHeader: DeltaInstructionHeader{From: FromNew, Size: 64}, Data: bytes.Repeat([]byte{'a'}, 64)},
+		{DeltaInstructionHeader: DeltaInstructionHeader{From: FromNew, Size: 300}, Data: bytes.Repeat([]byte{'b'}, 300)},
+		{DeltaInstructionHeader: DeltaInstructionHeader{From: FromOld, Offset: 0x10000, Size: 0x100}},
+		{DeltaInstructionHeader: DeltaInstructionHeader{From: FromOld, Offset: 1 << 40, Size: 1}},
+	} {
+		buf := bytes.NewBuffer(nil)
+		require.NoError(rdiffWriter{buf}.writeInstruction(i))
+
+		header, err := readRdiffCommand(buf)
+		require.NoError(err)
+		require.Equal(i.DeltaInstructionHeader, header)
+		if header.From == FromNew {
+			require.Equal(i.Data, buf.Next(int(header.Size)))
+		}
+		require.Zero(buf.Len())
+	}
+
+	// LITERAL_N2, COPY_N4_N2
+	buf := bytes.NewBuffer([]byte{0x42, 0x01, 0x2c, 0x4e, 0x0, 0x1, 0x0, 0x0, 0x01, 0x0})
+	header, err := readRdiffCommand(buf)
+	require.NoError(err)
+	require.Equal(DeltaInstructionHeader{From: FromNew, Size: 300}, header)
+	header, err = readRdiffCommand(buf)
+	require.NoError(err)
+	require.Equal(DeltaInstructionHeader{From: FromOld, Offset: 0x10000, Size: 0x100}, header)
+
+	_, err = readRdiffCommand(bytes.NewBuffer([]byte{0x55}))
+	require.Error(err)
+}
+
+func TestRdiffDeltaTruncated(t *testing.T) {
+	require := require.New(t)
+
+	sig, err := WriteSignature(strings.NewReader(basisText), bytes.NewBuffer(nil), blockSize, strongSize)
+	require.NoError(err)
+
+	delta := bytes.NewBuffer(nil)
+	err = DeltaOptions{Format: Rdiff}.WriteDelta(sig, strings.NewReader(newText), delta)
+	require.NoError(err)
+
+	b := delta.Bytes()
+	for n := len(b) - 1; n > 4; n-- {
+		_, err = ReadDelta(bytes.NewReader(b[:n]))
+		require.Errorf(err, "truncated at %d", n)
+	}
+}
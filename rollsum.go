@@ -0,0 +1,88 @@
+package diff
+
+const rollCharOffset = 31
+
+// checksum32 was taken from librsync:
+// https://github.com/librsync/librsync/blob/master/src/rollsum.c
+func checksum32(p []byte) uint32 {
+	s1 := uint16(0)
+	s2 := uint16(0)
+	l := len(p)
+	for n := 0; n < l; {
+		if n+15 < l {
+			for i := 0; i < 16; i++ {
+				s1 += uint16(p[n+i])
+				s2 += s1
+			}
+			n += 16
+		} else {
+			s1 += uint16(p[n])
+			s2 += s1
+			n += 1
+		}
+	}
+
+	s1 += uint16(l * rollCharOffset)
+	s2 += uint16(((l * (l + 1)) / 2) * rollCharOffset)
+	return (uint32(s2) << 16) | (uint32(s1) & 0xffff)
+}
+
+// rollingHash is a weak checksum of a window, which can be updated as the window slides.
+type rollingHash interface {
+	reset()
+	// rollin appends p to the window.
+	rollin(p []byte)
+	// rotate removes the first byte (out) from the window and appends a new one (in).
+	rotate(out, in byte)
+	// roll slides the window (of size bytes, rolled in from p[:size]) through p, up to the first window
+	// with a checksum in the filter, and returns its start. If there is none, it stops at the last window of p.
+	roll(p []byte, size int, filter *weakFilter) (start int, ok bool)
+	sum() uint32
+}
+
+// rollsum is the rolling version of checksum32, and is heavily inspired by librsync:
+// https://github.com/librsync/librsync/blob/master/src/rollsum.h
+type rollsum struct {
+	count  int
+	s1, s2 uint16
+}
+
+func (rs *rollsum) reset() {
+	rs.count = 0
+	rs.s1 = 0
+	rs.s2 = 0
+}
+
+func (rs *rollsum) rollin(p []byte) {
+	s1, s2 := rs.s1, rs.s2
+	for _, in := range p {
+		s1 += uint16(in) + uint16(rollCharOffset)
+		s2 += s1
+	}
+	rs.s1, rs.s2 = s1, s2
+	rs.count += len(p)
+}
+
+func (rs *rollsum) rotate(out, in byte) {
+	rs.s1 += uint16(in) - uint16(out)
+	rs.s2 += rs.s1 - uint16(rs.count)*(uint16(out)+uint16(rollCharOffset))
+}
+
+func (rs *rollsum) roll(p []byte, size int, filter *weakFilter) (int, bool) {
+	s1, s2 := rs.s1, rs.s2
+	count := uint16(rs.count)
+	n := 0
+	ok := filter.has(uint32(s2)<<16 | uint32(s1))
+	for ; !ok && n+size < len(p); n++ {
+		out, in := p[n], p[n+size]
+		s1 += uint16(in) - uint16(out)
+		s2 += s1 - count*(uint16(out)+uint16(rollCharOffset))
+		ok = filter.has(uint32(s2)<<16 | uint32(s1))
+	}
+	rs.s1, rs.s2 = s1, s2
+	return n, ok
+}
+
+func (rs *rollsum) sum() uint32 {
+	return (uint32(rs.s2) << 16) | (uint32(rs.s1) & 0xffff)
+}
@@ -0,0 +1,45 @@
+package diff
+
+import "testing"
+
+func TestChecksum32(t *testing.T) {
+	testRollingHash(t, Rollsum)
+}
+
+// testRollingHash rolls a window of 4 bytes through a string, and compares the rolling sums
+// with the checksums of the windows.
+func testRollingHash(t *testing.T, weakHash WeakHash) {
+	const size = 4
+	bstr := []byte("1234567890abcdefghijk")
+
+	rh := weakHash.newRollingHash()
+	rh.rollin(bstr[:size])
+	for n := 0; ; n++ {
+		c1 := weakHash.checksum(bstr[n : n+size])
+		c2 := rh.sum()
+		t.Logf("%s(%s): %d, rolling: %d", weakHash, bstr[n:n+size], c1, c2)
+		if c1 != c2 {
+			t.Fatalf("expected: %d, got: %d", c1, c2)
+		}
+		if n+size == len(bstr) {
+			break
+		}
+		rh.rotate(bstr[n], bstr[n+size])
+	}
+
+	// roll stops at the first window passing the filter
+	signature := &Signature{signatureChecksum: newSignatureChecksum(1, 1)}
+	signature.add(weakHash.checksum([]byte("90ab")), []byte{0})
+	filter := newWeakFilter(signature)
+	rh.reset()
+	rh.rollin(bstr[:size])
+	n, ok := rh.roll(bstr, size, filter)
+	if !ok || n != 8 || rh.sum() != weakHash.checksum([]byte("90ab")) {
+		t.Fatalf("expected window 8, got: %d (%v)", n, ok)
+	}
+	rh.rotate(bstr[n], bstr[n+size])
+	n, ok = rh.roll(bstr[n+1:], size, &weakFilter{bits: make([]uint64, 1), shift: 26})
+	if ok || n != len(bstr)-9-size || rh.sum() != weakHash.checksum(bstr[len(bstr)-size:]) {
+		t.Fatalf("expected the last window, got: %d (%v)", n, ok)
+	}
+}
@@ -0,0 +1,236 @@
+package diff
+
+import (
+	"bytes"
+	"io"
+)
+
+// defaultScanBufferSize is the size of the buffer the new file is read into, unless DeltaOptions.BufferSize is set.
+const defaultScanBufferSize = 256 * 1024
+
+// weakFilter is a bitset of the weak checksums in a signature. Most windows of the new file match no block,
+// and are rejected by a single bit test instead of a map lookup.
+type weakFilter struct {
+	bits []uint64
+	// shift leaves the index of the bit, out of the (multiplicatively hashed) weak checksum.
+	shift uint32
+}
+
+// newWeakFilter returns the filter of all weak checksums in the signature, with about 64 bits per checksum
+// (~1.5% of the windows without a matching block pass it) and 32MB at most.
+func newWeakFilter(signature *Signature) *weakFilter {
+	size := uint32(12)
+	for size < 28 && 1<<size < 64*signature.count() {
+		size++
+	}
+
+	f := &weakFilter{bits: make([]uint64, 1<<size/64), shift: 32 - size}
+	for i := range signature.index {
+		n := f.index(signature.index.weak(i))
+		f.bits[n/64] |= 1 << (n % 64)
+	}
+	return f
+}
+
+func (f *weakFilter) index(weak uint32) uint32 {
+	// Rollsum checksums are poorly distributed in their low bits, so they are hashed (Fibonacci hashing)
+	return (weak * 0x9e3779b1) >> f.shift
+}
+
+func (f *weakFilter) has(weak uint32) bool {
+	n := f.index(weak)
+	return f.bits[n/64]&(1<<(n%64)) != 0
+}
+
+// writeDeltaInstructions matches newReader against the signature, writes the instructions out to w
+// and returns the number of bytes read from newReader. filter, unless nil, is the filter of the signature.
+//
+// The new file is read into a buffer, which is scanned in place: the weak checksum is rolled through the buffer
+// until a window passes the filter, and only then the window is looked up and hashed (without being copied).
+// Literal data is written out in chunks, whenever a block is matched or the buffer is refilled.
+func writeDeltaInstructions(signature *Signature, filter *weakFilter, newReader io.Reader, w instructionWriter, o DeltaOptions) (uint64, error) {
+	if filter == nil {
+		filter = newWeakFilter(signature)
+	}
+	blockSize := int(signature.BlockSize)
+	bufferSize := o.BufferSize
+	if bufferSize <= 0 {
+		bufferSize = defaultScanBufferSize
+	}
+	buf := make([]byte, max(bufferSize, 2*blockSize))
+
+	roll := signature.WeakHash.newRollingHash()
+	h := signature.newHash()
+	strong := make([]byte, 0, h.Size())
+	// blockStrong is read into, if the signature is backed by a reader
+	blockStrong := make([]byte, signature.StrongSize)
+	i := &DeltaInstruction{}
+	literal := &DeltaInstruction{DeltaInstructionHeader: DeltaInstructionHeader{From: FromNew}}
+	length := uint64(0)
+	// copyEnd is the end of the previous copy (in the basis)
+	copyEnd := uint64(0)
+
+	// match returns the offset of the basis block matching the window, preferring the block following the pending copy.
+	match := func(window []byte, weak uint32, follows bool) (offset uint64, ok bool, err error) {
+		idx := signature.index.lookup(weak)
+		if o.InOrder {
+			// blocks are in basis order, skip those before the end of the previous copy
+			for len(idx) > 0 && uint64(idx.block(0))*uint64(blockSize) < copyEnd {
+				idx = idx[1:]
+			}
+		}
+		if len(idx) == 0 {
+			return 0, false, nil
+		}
+
+		h.Reset()
+		h.Write(window)
+		strong = h.Sum(strong[:0])[:signature.StrongSize]
+		for k := range idx {
+			n := idx.block(k)
+			s, err := signature.strongChecksum(n, blockStrong)
+			if err != nil {
+				return 0, false, err
+			}
+			if !bytes.Equal(s, strong) {
+				continue
+			}
+			blockOffset := uint64(n) * uint64(blockSize)
+			if follows && i.Offset+i.Size == blockOffset {
+				return blockOffset, true, nil
+			}
+			if !ok {
+				offset, ok = blockOffset, true
+			}
+		}
+		return offset, ok, nil
+	}
+	// matchFinal returns the offset of the final basis block, if it matches the window (at the end of the new file).
+	matchFinal := func(window []byte, weak uint32) (uint64, bool, error) {
+		n := signature.count() - 1
+		offset := uint64(n) * uint64(blockSize)
+		// blocks are in basis order, so the final block is the last one with its weak checksum
+		idx := signature.index.lookup(weak)
+		if len(idx) == 0 || idx.block(len(idx)-1) != n || (o.InOrder && offset < copyEnd) {
+			return 0, false, nil
+		}
+
+		h.Reset()
+		h.Write(window)
+		strong = h.Sum(strong[:0])[:signature.StrongSize]
+		s, err := signature.strongChecksum(n, blockStrong)
+		return offset, err == nil && bytes.Equal(s, strong), err
+	}
+	appendLiteral := func(data []byte) error {
+		literal.Size, literal.Data = uint64(len(data)), data
+		return i.append(w, literal)
+	}
+	appendCopy := func(offset uint64, size int) error {
+		copyEnd = offset + uint64(size)
+		return i.append(w, &DeltaInstruction{DeltaInstructionHeader: DeltaInstructionHeader{From: FromOld, Offset: offset, Size: uint64(size)}})
+	}
+
+	// buf[lit:pos] is literal data (not written out yet), buf[pos:pos+blockSize] is the window and buf[end:] is free.
+	// rolled is set once the window was rolled in, checked once it was looked up.
+	lit, pos, end := 0, 0, 0
+	rolled, checked, eof := false, false, false
+	for {
+		if !eof && end-pos <= blockSize {
+			// move the window to the front, and fill the buffer
+			if err := appendLiteral(buf[lit:pos]); err != nil {
+				return length, err
+			}
+			end = copy(buf, buf[pos:end])
+			lit, pos = 0, 0
+
+			n, err := io.ReadFull(newReader, buf[end:])
+			end += n
+			length += uint64(n)
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				eof = true
+			} else if err != nil {
+				return length, err
+			}
+		}
+		if end-pos < blockSize {
+			// the rest is shorter than a block
+			break
+		}
+
+		if !rolled {
+			roll.reset()
+			roll.rollin(buf[pos : pos+blockSize])
+			rolled, checked = true, false
+		}
+		if checked {
+			if end-pos == blockSize {
+				// the last window (at EOF)
+				break
+			}
+			roll.rotate(buf[pos], buf[pos+blockSize])
+			pos++
+		}
+
+		n, ok := roll.roll(buf[pos:end], blockSize, filter)
+		pos += n
+		checked = true
+		if !ok {
+			continue
+		}
+
+		window := buf[pos : pos+blockSize]
+		offset, ok, err := match(window, roll.sum(), lit == pos && i.From == FromOld && i.Size > 0)
+		if err != nil {
+			return length, err
+		}
+		if ok {
+			if err := appendLiteral(buf[lit:pos]); err != nil {
+				return length, err
+			}
+			if err := appendCopy(offset, blockSize); err != nil {
+				return length, err
+			}
+			pos += blockSize
+			lit = pos
+			rolled = false
+		}
+	}
+
+	// The basis may end with a short block, which can only be matched by the end of the new file.
+	// Unless the signature records its size, it is looked for in the window left after the last match.
+	window, known := buf[pos:end], false
+	if size, ok := signature.finalBlockSize(); ok {
+		window, known = nil, true
+		if size > 0 && end-lit >= int(size) {
+			window = buf[end-int(size) : end]
+		}
+	}
+	if start := end - len(window); len(window) > 0 && len(window) < blockSize {
+		weak := signature.WeakHash.checksum(window)
+		if filter.has(weak) {
+			offset, ok, err := uint64(0), false, error(nil)
+			if known {
+				offset, ok, err = matchFinal(window, weak)
+			} else {
+				offset, ok, err = match(window, weak, lit == start && i.From == FromOld && i.Size > 0)
+			}
+			if err != nil {
+				return length, err
+			}
+			if ok {
+				if err := appendLiteral(buf[lit:start]); err != nil {
+					return length, err
+				}
+				if err := appendCopy(offset, len(window)); err != nil {
+					return length, err
+				}
+				lit = end
+			}
+		}
+	}
+	// the rest is new
+	if err := appendLiteral(buf[lit:end]); err != nil {
+		return length, err
+	}
+	return length, i.flush(w)
+}
@@ -0,0 +1,106 @@
+package diff
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestScanner(t *testing.T) {
+	require := require.New(t)
+
+	rnd := rand.New(rand.NewSource(3))
+	for n := 0; n < 100; n++ {
+		basis := make([]byte, rnd.Intn(10000))
+		rnd.Read(basis)
+		// a mix of basis ranges and new data
+		newData := []byte{}
+		for len(newData) < 12000 && rnd.Intn(20) > 0 {
+			if rnd.Intn(3) == 0 || len(basis) == 0 {
+				b := make([]byte, rnd.Intn(300))
+				rnd.Read(b)
+				newData = append(newData, b...)
+			} else {
+				from := rnd.Intn(len(basis))
+				newData = append(newData, basis[from:from+rnd.Intn(len(basis)-from+1)]...)
+			}
+		}
+
+		sigOpts := SignatureOptions{
+			BlockSize:  uint32(1 + rnd.Intn(700)),
+			StrongSize: 16,
+			WeakHash:   WeakHash(rnd.Intn(2)),
+		}
+		sig, err := sigOpts.WriteSignature(bytes.NewReader(basis), io.Discard)
+		require.NoError(err)
+
+		opts := DeltaOptions{InOrder: rnd.Intn(2) == 0}
+		expected := bytes.NewBuffer(nil)
+		require.NoError(opts.WriteDelta(sig, bytes.NewReader(newData), expected))
+
+		// the instructions do not depend on how the new file is read
+		opts.BufferSize = 1 + rnd.Intn(3*int(sigOpts.BlockSize))
+		delta := bytes.NewBuffer(nil)
+		require.NoError(opts.WriteDelta(sig, iotest.OneByteReader(bytes.NewReader(newData)), delta))
+		instr1, err := ReadDelta(bytes.NewReader(expected.Bytes()))
+		require.NoError(err)
+		instr2, err := ReadDelta(bytes.NewReader(delta.Bytes()))
+		require.NoError(err)
+		require.Equal(instr1, instr2, "case %d", n)
+
+		buf := bytes.NewBuffer(nil)
+		if opts.InOrder {
+			require.NoError(PatchStream(bytes.NewReader(basis), bytes.NewReader(delta.Bytes()), buf))
+		} else {
+			require.NoError(Patch(bytes.NewReader(basis), bytes.NewReader(delta.Bytes()), buf))
+		}
+		require.Equal(string(newData), buf.String(), "case %d", n)
+	}
+}
+
+func BenchmarkScan(b *testing.B) {
+	rnd := rand.New(rand.NewSource(1))
+	basis := make([]byte, 16*defaultChunkSize)
+	rnd.Read(basis)
+	unrelated := make([]byte, len(basis))
+	rnd.Read(unrelated)
+	// every 64KB, a few bytes are changed
+	edited := append([]byte(nil), basis...)
+	for n := 0; n < len(edited); n += 64 * 1024 {
+		copy(edited[n:], "edited")
+	}
+
+	for _, weakHash := range []WeakHash{Rollsum, RabinKarp} {
+		sig, err := SignatureOptions{BlockSize: 2048, StrongSize: 16, WeakHash: weakHash}.WriteSignature(bytes.NewReader(basis), io.Discard)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		for _, bench := range []struct {
+			name    string
+			newData []byte
+		}{
+			// every window is rolled and rejected
+			{"unrelated", unrelated},
+			// every block is matched, the strong hash dominates
+			{"identical", basis},
+			{"shifted", append([]byte("shifted"), basis...)},
+			{"edited", edited},
+		} {
+			b.Run(fmt.Sprintf("%s/%s", weakHash, bench.name), func(b *testing.B) {
+				b.SetBytes(int64(len(bench.newData)))
+				b.ReportAllocs()
+				for n := 0; n < b.N; n++ {
+					if err := WriteDelta(sig, bytes.NewReader(bench.newData), io.Discard); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
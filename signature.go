@@ -1,8 +1,23 @@
 package diff
 
 import (
-	"errors"
+	"bufio"
+	"bytes"
+	"fmt"
+	"hash"
 	"io"
+	"math"
+)
+
+const (
+	// signatureMagic starts every versioned signature ("dsig").
+	// Read as a legacy block size it would be ~1.6GB, so both formats can be told apart.
+	signatureMagic   = uint32(0x64736967)
+	signatureVersion = byte(1)
+
+	// maxLegacyBlockSize bounds the block size of legacy signatures (as the original signature command did),
+	// whose first 4 bytes are taken as the block size whatever they are.
+	maxLegacyBlockSize = uint32(64 * 1024 * 1024)
 )
 
 type (
@@ -12,158 +27,558 @@ type (
 	}
 
 	signatureHeader struct {
-		BlockSize  uint32
-		StrongSize byte
+		Format Format
+		// Version is 0 for the legacy (headerless) format, and librsync signatures.
+		Version     byte
+		WeakHash    WeakHash
+		StrongHash  StrongHash
+		BlockSize   uint32
+		StrongSize  byte
+		BasisLength uint64
+		// BasisDigest is the digest of the whole basis.
+		BasisDigest []byte
 	}
 
-	signatureChecksum struct {
-		weak   map[uint32]int
-		strong [][]byte
+	// Block is a basis block with its checksums.
+	Block struct {
+		Weak   uint32
+		Strong []byte
+		Offset uint64
+		Size   uint32
+	}
+
+	// SignatureOptions configures how a signature is generated.
+	// The zero value writes native signatures with Rollsum and MD5 checksums, and recommended block and strong sizes.
+	SignatureOptions struct {
+		// Format is the wire format of the signature.
+		Format Format
+		// BlockSize is the block size, 0 uses RecommendBlockSize for the basis length (if the basis reader knows it).
+		BlockSize uint32
+		// StrongSize is the strong checksum size, 0 uses the size recommended for the basis length and block size.
+		StrongSize byte
+		WeakHash   WeakHash
+		StrongHash StrongHash
+		// BufferSize is the size of the buffer the basis is read through, 0 reads it directly.
+		BufferSize int
+		// Workers is the number of goroutines checksumming blocks. WriteSignature checksums them
+		// in the calling goroutine if it is 0 (or 1), WriteSignatureAt uses GOMAXPROCS goroutines if it is 0.
+		Workers int
+		// NoDigest leaves the basis digest out of native signatures (and so out of their deltas), so the basis
+		// cannot be verified before it is patched. The whole basis is hashed in a single goroutine, which bounds
+		// the speedup of Workers.
+		NoDigest bool
 	}
 )
 
 // WriteSignature generates the signature of a basis reader, and writes it out to signatureWriter.
+// Strong checksums are MD5 digests. Zero sizes are recommended, see SignatureOptions.
 func WriteSignature(basisReader io.Reader, signatureWriter io.Writer, blockSize uint32, strongSize byte) (*Signature, error) {
-	if blockSize == 0 {
-		return nil, errors.New("block size must be > 0")
+	return SignatureOptions{BlockSize: blockSize, StrongSize: strongSize, StrongHash: MD5}.WriteSignature(basisReader, signatureWriter)
+}
+
+// WriteSignature generates the signature of a basis reader, and writes it out to signatureWriter.
+func (o SignatureOptions) WriteSignature(basisReader io.Reader, signatureWriter io.Writer) (*Signature, error) {
+	basisLength := readerLength(basisReader)
+	o, sum, err := o.basisChecksummer(basisReader, basisLength)
+	if err != nil {
+		return nil, err
 	}
-	if strongSize == 0 {
-		return nil, errors.New("strong size must be > 0")
+	return o.writeSignature(sum, basisLength, signatureWriter)
+}
+
+// NewSignature generates the signature of a basis reader in memory, without writing it out (e.g. to write a delta right away).
+// The signature is a native one whatever the Format, so it records the basis length and digest (unless NoDigest).
+func (o SignatureOptions) NewSignature(basisReader io.Reader) (*Signature, error) {
+	o, sum, err := o.basisChecksummer(basisReader, readerLength(basisReader))
+	if err != nil {
+		return nil, err
+	}
+	return newNativeSignature(sum, io.Discard, o)
+}
+
+// basisChecksummer returns the options with the sizes for basisReader (of basisLength bytes, if known), and the checksummer reading it.
+func (o SignatureOptions) basisChecksummer(basisReader io.Reader, basisLength uint64) (SignatureOptions, checksummer, error) {
+	o, err := o.withSizes(basisLength)
+	if err != nil {
+		return o, nil, err
+	}
+	if o.BufferSize > 0 {
+		basisReader = bufio.NewReaderSize(basisReader, o.BufferSize)
+	}
+
+	sum := func(w io.Writer, digest hash.Hash) (signatureChecksum, uint64, error) {
+		r := basisReader
+		if digest != nil {
+			r = io.TeeReader(basisReader, digest)
+		}
+		return writeSignatureChecksum(r, w, o.BlockSize, o.StrongSize, o.WeakHash, o.StrongHash.New())
+	}
+	if o.Workers > 1 {
+		sum = func(w io.Writer, digest hash.Hash) (signatureChecksum, uint64, error) {
+			return writeSignatureChecksumParallel(basisReader, nil, 0, w, digest, o)
+		}
+	}
+	return o, sum, nil
+}
+
+// withSizes returns the options with recommended (unless given) sizes for a basis of basisLength bytes, and validates them.
+func (o SignatureOptions) withSizes(basisLength uint64) (SignatureOptions, error) {
+	if o.BlockSize == 0 {
+		o.BlockSize, _ = RecommendBlockSize(basisLength, o.StrongHash)
+	}
+	if o.StrongSize == 0 {
+		o.StrongSize = recommendStrongSize(basisLength, o.BlockSize, o.StrongHash)
+	}
+	return o, validateSignature(o.BlockSize, o.StrongSize, o.WeakHash, o.StrongHash)
+}
+
+// checksummer writes the checksums of all basis blocks out to w, and returns them with the basis length.
+// digest, unless nil, is written the whole basis.
+type checksummer func(w io.Writer, digest hash.Hash) (signatureChecksum, uint64, error)
+
+// writeSignature writes the signature of the basis, of basisLength bytes (or UnknownLength), out to signatureWriter.
+func (o SignatureOptions) writeSignature(sum checksummer, basisLength uint64, signatureWriter io.Writer) (*Signature, error) {
+	switch o.Format {
+	case Native:
+		return writeNativeSignature(sum, basisLength, signatureWriter, o)
+	case Rdiff:
+		return writeRdiffSignature(sum, signatureWriter, o)
 	}
+	return nil, fmt.Errorf("%w: unsupported signature format: %v", ErrInvalidOptions, o.Format)
+}
 
-	header, err := writeSignatureHeader(signatureWriter, blockSize, strongSize)
+func writeNativeSignature(sum checksummer, basisLength uint64, signatureWriter io.Writer, o SignatureOptions) (*Signature, error) {
+	if basisLength == UnknownLength {
+		// The header carries the basis length, so checksums are buffered until the basis is consumed.
+		buf := bytes.NewBuffer(nil)
+		sig, err := newNativeSignature(sum, buf, o)
+		if err != nil {
+			return nil, err
+		}
+		if err = writeSignatureHeader(signatureWriter, sig.signatureHeader); err != nil {
+			return nil, err
+		}
+		if _, err = buf.WriteTo(signatureWriter); err != nil {
+			return nil, err
+		}
+		return sig, writeDigest(signatureWriter, sig.BasisDigest)
+	}
+
+	header := o.nativeHeader()
+	header.BasisLength = basisLength
+	if err := writeSignatureHeader(signatureWriter, header); err != nil {
+		return nil, err
+	}
+	sig, err := newNativeSignature(sum, signatureWriter, o)
 	if err != nil {
 		return nil, err
 	}
-	checksum, err := writeSignatureChecksum(basisReader, signatureWriter, blockSize, strongSize)
+	if sig.BasisLength != basisLength {
+		if sig.BasisLength < basisLength {
+			return nil, fmt.Errorf("%w: expected %d, read %d: %w", ErrLengthChanged, basisLength, sig.BasisLength, io.ErrUnexpectedEOF)
+		}
+		return nil, fmt.Errorf("%w: expected %d, read %d", ErrLengthChanged, basisLength, sig.BasisLength)
+	}
+	return sig, writeDigest(signatureWriter, sig.BasisDigest)
+}
+
+// newNativeSignature checksums the basis, writes the checksums out to w, and returns the native signature.
+func newNativeSignature(sum checksummer, w io.Writer, o SignatureOptions) (*Signature, error) {
+	var digest hash.Hash
+	if !o.NoDigest {
+		digest = o.StrongHash.New()
+	}
+	checksum, basisLength, err := sum(w, digest)
 	if err != nil {
 		return nil, err
 	}
+
+	header := o.nativeHeader()
+	header.BasisLength = basisLength
+	if digest != nil {
+		header.BasisDigest = digest.Sum(nil)
+	}
 	return &Signature{header, checksum}, nil
 }
 
+// nativeHeader returns the header of native signatures, without the basis length and digest.
+func (o SignatureOptions) nativeHeader() signatureHeader {
+	return signatureHeader{
+		Version:    signatureVersion,
+		WeakHash:   o.WeakHash,
+		StrongHash: o.StrongHash,
+		BlockSize:  o.BlockSize,
+		StrongSize: o.StrongSize,
+	}
+}
+
 // ReadSignature reads the signature from signatureReader.
+// Legacy signatures, without the versioned header, and librsync signatures are accepted as well.
 func ReadSignature(signatureReader io.Reader) (*Signature, error) {
 	header, err := readSignatureHeader(signatureReader)
 	if err != nil {
-		return nil, err
+		return nil, invalidSignature(err)
 	}
+	return readSignature(signatureReader, header, header.newChecksum())
+}
 
-	checksum, err := readSignatureChecksum(signatureReader, header.StrongSize)
+// OpenSignature reads the signature from signatureReaderAt like ReadSignature, but keeps only the weak checksums in memory
+// (8 bytes per block): strong checksums are read with ReadAt whenever a weak checksum matches, e.g. from an *os.File
+// or a memory-mapped file. signatureReaderAt must not change, nor be closed, while the signature is in use.
+func OpenSignature(signatureReaderAt io.ReaderAt) (*Signature, error) {
+	section := io.NewSectionReader(signatureReaderAt, 0, math.MaxInt64)
+	r := bufio.NewReaderSize(section, 64*1024)
+	header, err := readSignatureHeader(r)
 	if err != nil {
+		return nil, invalidSignature(err)
+	}
+
+	checksum := header.newChecksum()
+	checksum.strong = nil
+	checksum.strongReader = signatureReaderAt
+	if checksum.strongOffset, err = section.Seek(0, io.SeekCurrent); err != nil {
 		return nil, err
 	}
+	checksum.strongOffset -= int64(r.Buffered())
+	return readSignature(r, header, checksum)
+}
+
+// newChecksum returns empty checksums, with room for all blocks if the header records the basis length.
+func (header signatureHeader) newChecksum() signatureChecksum {
+	blocks := uint64(0)
+	if header.Format == Native && header.Version > 0 {
+		blocks = header.blocks()
+	}
+	return newSignatureChecksum(header.StrongSize, blocks)
+}
+
+// readSignature reads the checksums following the header into checksum, and the trailer (versioned signatures only).
+func readSignature(r io.Reader, header signatureHeader, checksum signatureChecksum) (*Signature, error) {
+	if header.Format != Native || header.Version == 0 {
+		// the checksums run up to the end
+		if err := readSignatureChecksum(r, &checksum, -1); err != nil {
+			return nil, invalidSignature(err)
+		}
+		return &Signature{header, checksum}, nil
+	}
 
+	if header.blocks() > maxBlocks {
+		return nil, fmt.Errorf("%w: basis length %d needs more than %d blocks", ErrInvalidSignature, header.BasisLength, maxBlocks)
+	}
+	if err := readSignatureChecksum(r, &checksum, int64(header.blocks())); err != nil {
+		return nil, invalidSignature(err)
+	}
+	// basis digest
+	var err error
+	if header.BasisDigest, err = readDigest(r); err != nil {
+		return nil, invalidSignature(err)
+	}
+	var b [1]byte
+	if n, _ := r.Read(b[:]); n > 0 {
+		return nil, fmt.Errorf("%w: unexpected data after signature trailer", ErrInvalidSignature)
+	}
 	return &Signature{header, checksum}, nil
 }
 
-// Lookup retrieves to block for a given weak checksum.
+// invalidSignature marks a truncated (or empty) signature as invalid, other (I/O) errors are returned as they are.
+func invalidSignature(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("%w: %w", ErrInvalidSignature, io.ErrUnexpectedEOF)
+	}
+	return err
+}
+
+// Lookup retrieves the (first) block for a given weak checksum.
+// The final block may be shorter than the block size, if the signature records the basis length.
+// It keeps its original signature, so it reports blocks of signatures opened with OpenSignature whose strong checksum
+// cannot be read as not found: use LookupAll to tell read errors apart.
 func (sig *Signature) Lookup(weak uint32) (strong []byte, offset uint64, blockSize uint32, ok bool) {
-	var idx int
-	idx, ok = sig.weak[weak]
-	if !ok {
+	idx := sig.index.lookup(weak)
+	if len(idx) == 0 {
 		return
 	}
 
-	strong = sig.strong[idx]
-	offset = uint64(idx) * uint64(sig.BlockSize)
-	blockSize = sig.BlockSize
+	n := idx.block(0)
+	if strong, err := sig.strongChecksum(n, nil); err == nil {
+		return strong, uint64(n) * uint64(sig.BlockSize), sig.blockSize(n), true
+	}
 	return
 }
 
-func writeSignatureHeader(w io.Writer, blockSize uint32, strongSize byte) (header signatureHeader, err error) {
-	var b [4 + 1]byte
+// LookupAll retrieves all blocks for a given weak checksum, in basis order.
+// It returns the error reading a strong checksum of a signature opened with OpenSignature.
+func (sig *Signature) LookupAll(weak uint32) ([]Block, error) {
+	idx := sig.index.lookup(weak)
+	if len(idx) == 0 {
+		return nil, nil
+	}
+
+	blocks := make([]Block, 0, len(idx))
+	for i := range idx {
+		n := idx.block(i)
+		strong, err := sig.strongChecksum(n, nil)
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, Block{
+			Weak:   weak,
+			Strong: strong,
+			Offset: uint64(n) * uint64(sig.BlockSize),
+			Size:   sig.blockSize(n),
+		})
+	}
+	return blocks, nil
+}
+
+// BlockCount returns the number of basis blocks.
+func (sig *Signature) BlockCount() int {
+	return sig.count()
+}
+
+// Length returns the basis length, and whether it is exact: legacy and librsync signatures do not record it,
+// so their basis is assumed to end with a full block.
+func (sig *Signature) Length() (length uint64, exact bool) {
+	if sig.Format == Native && sig.Version > 0 {
+		return sig.BasisLength, true
+	}
+	return uint64(sig.count()) * uint64(sig.BlockSize), false
+}
+
+// Blocks calls fn with every block in basis order, until fn returns false.
+// Strong checksums of signatures opened with OpenSignature are read as they are needed, and Blocks returns the read error.
+func (sig *Signature) Blocks(fn func(n int, b Block) bool) error {
+	// the index is sorted by weak checksum
+	weak := make([]uint32, sig.count())
+	for i := range sig.index {
+		weak[sig.index.block(i)] = sig.index.weak(i)
+	}
+
+	for n := range weak {
+		strong, err := sig.strongChecksum(n, nil)
+		if err != nil {
+			return err
+		}
+		b := Block{
+			Weak:   weak[n],
+			Strong: strong,
+			Offset: uint64(n) * uint64(sig.BlockSize),
+			Size:   sig.blockSize(n),
+		}
+		if !fn(n, b) {
+			break
+		}
+	}
+	return nil
+}
+
+func writeSignatureHeader(w io.Writer, header signatureHeader) error {
+	var b [4 + 1 + 1 + 1 + 4 + 1 + 8]byte
+	// magic
+	byteOrder.PutUint32(b[:4], signatureMagic)
+	// version
+	b[4] = header.Version
+	// weak & strong hash
+	b[5] = byte(header.WeakHash)
+	b[6] = byte(header.StrongHash)
 	// block size
-	ByteOrder.PutUint32(b[:4], blockSize)
+	byteOrder.PutUint32(b[7:11], header.BlockSize)
 	// strong size
-	b[4] = strongSize
+	b[11] = header.StrongSize
+	// basis length
+	byteOrder.PutUint64(b[12:], header.BasisLength)
 
-	if _, err = w.Write(b[:]); err != nil {
-		return
-	}
-	header = signatureHeader{BlockSize: blockSize, StrongSize: strongSize}
-	return
+	_, err := w.Write(b[:])
+	return err
 }
 
+// readSignatureHeader reads a versioned (or librsync) header, or falls back to the legacy
+// {block size, strong size} header if the stream does not start with a magic.
 func readSignatureHeader(r io.Reader) (header signatureHeader, err error) {
-	var b [4 + 1]byte
-	if _, err = r.Read(b[:]); err != nil {
+	var b [4 + 1 + 1 + 1 + 4 + 1 + 8]byte
+	if _, err = io.ReadFull(r, b[:4]); err != nil {
+		return
+	}
+
+	if weakHash, strongHash, ok := rdiffSignatureHashes(byteOrder.Uint32(b[:4])); ok {
+		return readRdiffSignatureHeader(r, weakHash, strongHash)
+	}
+	if magic := byteOrder.Uint32(b[:4]); magic == deltaMagic || magic == rdiffDeltaMagic {
+		return header, fmt.Errorf("%w: a delta, not a signature", ErrInvalidSignature)
+	}
+	if byteOrder.Uint32(b[:4]) != signatureMagic {
+		// legacy: block size
+		header.BlockSize = byteOrder.Uint32(b[:4])
+		if header.BlockSize > maxLegacyBlockSize {
+			return header, fmt.Errorf("%w: legacy block size %d > %d", ErrInvalidSignature, header.BlockSize, maxLegacyBlockSize)
+		}
+		// strong size
+		if _, err = io.ReadFull(r, b[4:5]); err != nil {
+			return header, noEOF(err)
+		}
+		header.StrongSize = b[4]
+		header.StrongHash = MD5
+		err = header.validate()
 		return
 	}
 
+	if _, err = io.ReadFull(r, b[4:]); err != nil {
+		return header, noEOF(err)
+	}
+	// version
+	header.Version = b[4]
+	if header.Version != signatureVersion {
+		return header, fmt.Errorf("%w: unsupported version: %d", ErrInvalidSignature, header.Version)
+	}
+	// weak & strong hash
+	header.WeakHash = WeakHash(b[5])
+	header.StrongHash = StrongHash(b[6])
 	// block size
-	header.BlockSize = ByteOrder.Uint32(b[:4])
+	header.BlockSize = byteOrder.Uint32(b[7:11])
 	// strong size
-	header.StrongSize = b[4]
+	header.StrongSize = b[11]
+	// basis length
+	header.BasisLength = byteOrder.Uint64(b[12:])
+	if err = header.validate(); err != nil {
+		return
+	}
 	return
 }
 
-func writeSignatureChecksum(r io.Reader, w io.Writer, blockSize uint32, strongSize byte) (signatureChecksum, error) {
-	checksum := signatureChecksum{weak: make(map[uint32]int)}
+// blocks returns the number of blocks covering the basis (versioned headers only).
+func (header signatureHeader) blocks() uint64 {
+	blocks := header.BasisLength / uint64(header.BlockSize)
+	if header.BasisLength%uint64(header.BlockSize) > 0 {
+		blocks++
+	}
+	return blocks
+}
+
+// finalBlockSize returns the size of the final basis block, if it is shorter than a block (or 0).
+// Legacy and librsync signatures do not record the basis length, so their final block is not known.
+func (header signatureHeader) finalBlockSize() (size uint32, ok bool) {
+	if header.Format != Native || header.Version == 0 {
+		return 0, false
+	}
+	return uint32(header.BasisLength % uint64(header.BlockSize)), true
+}
+
+// blockSize returns the size of the n-th block, the final block may be shorter (if known).
+func (sig *Signature) blockSize(n int) uint32 {
+	if size, ok := sig.finalBlockSize(); ok && size > 0 && n == sig.count()-1 {
+		return size
+	}
+	return sig.BlockSize
+}
+
+// newHash returns the hash computing strong checksums of blocks.
+// Legacy signatures do not record the algorithm, so they rely on NewHash.
+func (header signatureHeader) newHash() hash.Hash {
+	if header.Format == Native && header.Version == 0 {
+		return NewHash()
+	}
+	return header.StrongHash.New()
+}
+
+func validateSignature(blockSize uint32, strongSize byte, weakHash WeakHash, strongHash StrongHash) error {
+	if blockSize == 0 {
+		return fmt.Errorf("%w: block size must be > 0", ErrInvalidOptions)
+	}
+	if !weakHash.Available() {
+		return fmt.Errorf("%w: unsupported weak hash: %v", ErrInvalidOptions, weakHash)
+	}
+	if !strongHash.Available() {
+		return fmt.Errorf("%w: unsupported strong hash: %v", ErrInvalidOptions, strongHash)
+	}
+	if strongSize == 0 {
+		return fmt.Errorf("%w: strong size must be > 0", ErrInvalidOptions)
+	}
+	if int(strongSize) > strongHash.Size() {
+		return fmt.Errorf("%w: strong size must be <= hash size", ErrInvalidOptions)
+	}
+	return nil
+}
+
+func (header signatureHeader) validate() error {
+	if !header.WeakHash.Available() {
+		return fmt.Errorf("%w: unsupported weak hash: %v", ErrInvalidSignature, header.WeakHash)
+	}
+	if !header.StrongHash.Available() {
+		return fmt.Errorf("%w: unsupported strong hash: %v", ErrInvalidSignature, header.StrongHash)
+	}
+	if header.BlockSize == 0 || header.StrongSize == 0 || int(header.StrongSize) > header.newHash().Size() {
+		return fmt.Errorf("%w: block size %d, strong size %d", ErrInvalidSignature, header.BlockSize, header.StrongSize)
+	}
+	return nil
+}
+
+// writeSignatureChecksum writes the checksums of all blocks read from r, and returns them with the number of bytes read.
+func writeSignatureChecksum(r io.Reader, w io.Writer, blockSize uint32, strongSize byte, weakHash WeakHash, h hash.Hash) (signatureChecksum, uint64, error) {
+	checksum := newSignatureChecksum(strongSize, 0)
+	length := uint64(0)
 
 	var weak [4]byte
 	buf := make([]byte, blockSize)
-	h := NewHash()
-	for i := 0; ; i++ {
+	strong := make([]byte, 0, h.Size())
+	for {
 		n, err := io.ReadFull(r, buf)
 		if err != nil {
 			if err == io.EOF {
 				break
 			}
 			if err != io.ErrUnexpectedEOF {
-				return signatureChecksum{}, err
+				return signatureChecksum{}, 0, err
 			}
 		}
 
+		length += uint64(n)
+
 		// write weak checksum
-		v := checksum32(buf[:n])
-		ByteOrder.PutUint32(weak[:], v)
+		v := weakHash.checksum(buf[:n])
+		byteOrder.PutUint32(weak[:], v)
 		if _, err = w.Write(weak[:]); err != nil {
-			return signatureChecksum{}, err
+			return signatureChecksum{}, 0, err
 		}
-		checksum.weak[v] = i
 
 		// write strong checksum
 		h.Reset()
 		if _, err = h.Write(buf[:n]); err != nil {
-			return signatureChecksum{}, err
+			return signatureChecksum{}, 0, err
 		}
-		strong := h.Sum(nil)[:strongSize]
+		strong = h.Sum(strong[:0])[:strongSize]
 		if _, err = w.Write(strong); err != nil {
-			return signatureChecksum{}, err
+			return signatureChecksum{}, 0, err
+		}
+		if err = checksum.add(v, strong); err != nil {
+			return signatureChecksum{}, 0, fmt.Errorf("%w: %w, the block size is too small", ErrInvalidOptions, err)
 		}
-		checksum.strong = append(checksum.strong, make([]byte, strongSize))
-		copy(checksum.strong[i], strong)
 	}
 
-	return checksum, nil
+	checksum.sort()
+	return checksum, length, nil
 }
 
-func readSignatureChecksum(r io.Reader, strongSize byte) (signatureChecksum, error) {
-	checksum := signatureChecksum{weak: make(map[uint32]int)}
-
+// readSignatureChecksum reads the checksums of blocks blocks into checksum, or up to the end if blocks is negative.
+func readSignatureChecksum(r io.Reader, checksum *signatureChecksum, blocks int64) error {
 	var weak [4]byte
-	strong := make([]byte, strongSize)
-	for i := 0; ; i++ {
+	strong := make([]byte, checksum.strongSize)
+	for n := int64(0); blocks < 0 || n < blocks; n++ {
 		// read weak checksum
-		if _, err := r.Read(weak[:]); err != nil {
-			if err == io.EOF {
+		if _, err := io.ReadFull(r, weak[:]); err != nil {
+			if err == io.EOF && blocks < 0 {
 				break
 			}
-			return signatureChecksum{}, err
+			return noEOF(err)
 		}
 		// read strong checksum
-		if _, err := r.Read(strong); err != nil {
-			if err == io.EOF {
-				break
-			}
-			return signatureChecksum{}, err
+		if _, err := io.ReadFull(r, strong); err != nil {
+			return noEOF(err)
 		}
 
-		checksum.weak[ByteOrder.Uint32(weak[:])] = i
-		checksum.strong = append(checksum.strong, make([]byte, strongSize))
-		copy(checksum.strong[i], strong)
+		if err := checksum.add(byteOrder.Uint32(weak[:]), strong); err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidSignature, err)
+		}
 	}
 
-	return checksum, nil
+	checksum.sort()
+	return nil
 }
@@ -2,7 +2,12 @@ package diff
 
 import (
 	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"strings"
 	"testing"
+	"testing/iotest"
 
 	"github.com/stretchr/testify/require"
 )
@@ -12,17 +17,51 @@ func TestSignatureHeader(t *testing.T) {
 
 	buf := bytes.NewBuffer(nil)
 	header := signatureHeader{
-		StrongSize: 8,
-		BlockSize:  4096,
+		Version:     signatureVersion,
+		WeakHash:    Rollsum,
+		StrongHash:  MD5,
+		StrongSize:  8,
+		BlockSize:   4096,
+		BasisLength: 1 << 40,
 	}
 
-	h1, err := writeSignatureHeader(buf, header.BlockSize, header.StrongSize)
+	err := writeSignatureHeader(buf, header)
 	require.NoError(err)
-	require.Equal(header, h1)
 
-	h2, err := readSignatureHeader(buf)
+	h, err := readSignatureHeader(buf)
 	require.NoError(err)
-	require.Equal(header, h2)
+	require.Equal(header, h)
+}
+
+func TestSignatureHeaderLegacy(t *testing.T) {
+	require := require.New(t)
+
+	// {block size: 4096, strong size: 8}
+	buf := bytes.NewBuffer([]byte{0x0, 0x0, 0x10, 0x0, 0x8})
+
+	h, err := readSignatureHeader(buf)
+	require.NoError(err)
+	require.Equal(signatureHeader{StrongHash: MD5, BlockSize: 4096, StrongSize: 8}, h)
+}
+
+func TestSignatureHeaderInvalid(t *testing.T) {
+	require := require.New(t)
+
+	for _, b := range [][]byte{
+		// legacy, zero block size (a delta instruction)
+		{0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0xb},
+		// legacy, strong size > hash size
+		{0x0, 0x0, 0x10, 0x0, 0xff},
+		// version 0 (legacy signatures have no magic)
+		{0x64, 0x73, 0x69, 0x67, 0x0, 0x0, 0x1, 0x0, 0x0, 0x10, 0x0, 0x8, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0},
+		// unsupported version
+		{0x64, 0x73, 0x69, 0x67, 0xff, 0x0, 0x0, 0x0, 0x0, 0x10, 0x0, 0x8, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0},
+		// truncated
+		{0x64, 0x73, 0x69, 0x67, 0x1, 0x0, 0x0},
+	} {
+		_, err := readSignatureHeader(bytes.NewBuffer(b))
+		require.Error(err)
+	}
 }
 
 func TestSignatureChecksum(t *testing.T) {
@@ -43,11 +82,12 @@ func TestSignatureChecksum(t *testing.T) {
 	r := bytes.NewBufferString(text)
 	rw := bytes.NewBuffer(nil)
 
-	ch1, err := writeSignatureChecksum(r, rw, blockSize, strongSize)
+	ch1, n, err := writeSignatureChecksum(r, rw, blockSize, strongSize, Rollsum, NewHash())
 	require.NoError(err)
+	require.EqualValues(len(text), n)
 
-	ch2, err := readSignatureChecksum(rw, strongSize)
-	require.NoError(err)
+	ch2 := newSignatureChecksum(strongSize, 0)
+	require.NoError(readSignatureChecksum(rw, &ch2, -1))
 
 	require.EqualValues(ch1, ch2)
 }
@@ -77,11 +117,438 @@ func TestSignature(t *testing.T) {
 	require.NoError(err)
 
 	require.EqualValues(sig1, sig2)
+	require.EqualValues(len(text), sig2.BasisLength)
 
-	for weak := range sig1.weak {
-		strong, _, size, ok := sig2.Lookup(weak)
+	for i := range sig1.index {
+		strong, _, size, ok := sig2.Lookup(sig1.index.weak(i))
 		require.True(ok)
 		require.Truef(size > 0, "size > 0")
 		require.Len(strong, strongSize)
 	}
 }
+
+func TestSignatureLegacy(t *testing.T) {
+	require := require.New(t)
+
+	const (
+		strongSize = 4
+		blockSize  = 4
+
+		text = `ala ma kota,kot ma ale`
+	)
+	r := bytes.NewBufferString(text)
+	rw := bytes.NewBuffer([]byte{0x0, 0x0, 0x0, blockSize, strongSize})
+
+	ch, _, err := writeSignatureChecksum(r, rw, blockSize, strongSize, Rollsum, NewHash())
+	require.NoError(err)
+
+	sig, err := ReadSignature(rw)
+	require.NoError(err)
+	require.EqualValues(0, sig.Version)
+	require.EqualValues(blockSize, sig.BlockSize)
+	require.EqualValues(strongSize, sig.StrongSize)
+	require.EqualValues(ch, sig.signatureChecksum)
+}
+
+func TestSignatureTruncated(t *testing.T) {
+	require := require.New(t)
+
+	r := bytes.NewBufferString(`ala ma kota,kot ma ale`)
+	rw := bytes.NewBuffer(nil)
+
+	_, err := WriteSignature(r, rw, 4, 4)
+	require.NoError(err)
+
+	b := rw.Bytes()
+	// partial checksum
+	_, err = ReadSignature(bytes.NewBuffer(b[:len(b)-1]))
+	require.Error(err)
+	// missing checksum
+	_, err = ReadSignature(bytes.NewBuffer(b[:len(b)-8]))
+	require.Error(err)
+}
+
+func TestSignatureKnownLength(t *testing.T) {
+	require := require.New(t)
+
+	basis := bytes.Repeat([]byte(`ala ma kota,kot ma ale,`), 100)
+	opts := SignatureOptions{BlockSize: 16, StrongSize: 8}
+
+	// the length is not known: the checksums are buffered
+	expected := bytes.NewBuffer(nil)
+	sig, err := opts.WriteSignature(iotest.OneByteReader(bytes.NewReader(basis)), expected)
+	require.NoError(err)
+
+	// the length is known: the header is written before the basis is read
+	buf := bytes.NewBuffer(nil)
+	r := &lengthReader{Reader: &hookReader{Reader: bytes.NewReader(basis), hook: func() {
+		require.Positive(buf.Len())
+	}}, n: len(basis)}
+	sig2, err := opts.WriteSignature(r, buf)
+	require.NoError(err)
+	require.Equal(expected.Bytes(), buf.Bytes())
+	require.Equal(sig, sig2)
+	buf2 := bytes.NewBuffer(nil)
+	_, err = opts.WriteSignatureAt(bytes.NewReader(basis), int64(len(basis)), buf2)
+	require.NoError(err)
+	require.Equal(expected.Bytes(), buf2.Bytes())
+
+	// the basis is shorter, or longer, than its length
+	_, err = opts.WriteSignature(&lengthReader{bytes.NewReader(basis), len(basis) + 1}, io.Discard)
+	require.ErrorIs(err, ErrLengthChanged)
+	require.ErrorIs(err, io.ErrUnexpectedEOF)
+	_, err = opts.WriteSignature(&lengthReader{bytes.NewReader(basis), len(basis) - 1}, io.Discard)
+	require.ErrorIs(err, ErrLengthChanged)
+}
+
+func TestSignatureNoDigest(t *testing.T) {
+	require := require.New(t)
+
+	opts := SignatureOptions{BlockSize: blockSize, StrongSize: strongSize, NoDigest: true}
+	buf := bytes.NewBuffer(nil)
+	sig, err := opts.WriteSignature(strings.NewReader(basisText), buf)
+	require.NoError(err)
+	require.Nil(sig.BasisDigest)
+	read, err := ReadSignature(buf)
+	require.NoError(err)
+	require.Equal(sig, read)
+
+	// neither the basis nor the new file can be verified
+	delta := bytes.NewBuffer(nil)
+	err = DeltaOptions{NoDigest: true}.WriteDelta(sig, strings.NewReader(newText), delta)
+	require.NoError(err)
+	header, err := ReadDeltaHeader(bytes.NewReader(delta.Bytes()))
+	require.NoError(err)
+	require.Nil(header.BasisDigest)
+
+	out := bytes.NewBuffer(nil)
+	err = PatchOptions{VerifyBasis: true}.Patch(strings.NewReader(basisText), bytes.NewReader(delta.Bytes()), out)
+	require.NoError(err)
+	require.Equal(newText, out.String())
+	err = PatchOptions{VerifyBasis: true}.Patch(strings.NewReader(strings.ToUpper(basisText)), bytes.NewReader(delta.Bytes()), io.Discard)
+	require.NoError(err)
+}
+
+func TestSignatureLookupAll(t *testing.T) {
+	require := require.New(t)
+
+	const (
+		strongSize = 4
+		blockSize  = 4
+
+		// "baab" and "abba" share the weak checksum
+		text = `baababbabaab`
+	)
+	require.Equal(checksum32([]byte(text[:4])), checksum32([]byte(text[4:8])))
+
+	sig, err := WriteSignature(bytes.NewBufferString(text), bytes.NewBuffer(nil), blockSize, strongSize)
+	require.NoError(err)
+
+	blocks, err := sig.LookupAll(checksum32([]byte(text[:4])))
+	require.NoError(err)
+	require.Len(blocks, 3)
+	for i, b := range blocks {
+		require.EqualValues(i*blockSize, b.Offset)
+		require.EqualValues(blockSize, b.Size)
+		strong, err := sig.strongChecksum(i, nil)
+		require.NoError(err)
+		require.Equal(strong, b.Strong)
+	}
+	require.Equal(blocks[0].Strong, blocks[2].Strong)
+	require.NotEqual(blocks[0].Strong, blocks[1].Strong)
+
+	strong, offset, size, ok := sig.Lookup(checksum32([]byte(text[:4])))
+	require.True(ok)
+	require.Equal(blocks[0].Strong, strong)
+	require.Equal(blocks[0].Offset, offset)
+	require.Equal(blocks[0].Size, size)
+
+	blocks, err = sig.LookupAll(checksum32([]byte(`xxxx`)))
+	require.NoError(err)
+	require.Empty(blocks)
+
+	// the final block is shorter
+	sig, err = WriteSignature(bytes.NewBufferString(text+`ab`), bytes.NewBuffer(nil), blockSize, strongSize)
+	require.NoError(err)
+	blocks, err = sig.LookupAll(checksum32([]byte(`ab`)))
+	require.NoError(err)
+	require.Len(blocks, 1)
+	require.EqualValues(len(text), blocks[0].Offset)
+	require.EqualValues(2, blocks[0].Size)
+	_, _, size, ok = sig.Lookup(checksum32([]byte(`ab`)))
+	require.True(ok)
+	require.EqualValues(2, size)
+}
+
+func TestSignatureHash(t *testing.T) {
+	require := require.New(t)
+
+	const (
+		blockSize = 4
+
+		text = `ala ma kota,kot ma ale`
+	)
+	for _, h := range []StrongHash{MD5, SHA1, SHA256, BLAKE2b} {
+		rw := bytes.NewBuffer(nil)
+		sig1, err := SignatureOptions{BlockSize: blockSize, StrongSize: byte(h.Size()), StrongHash: h}.WriteSignature(bytes.NewBufferString(text), rw)
+		require.NoError(err)
+
+		sig2, err := ReadSignature(rw)
+		require.NoError(err)
+		require.EqualValues(sig1, sig2)
+		require.Equal(h, sig2.StrongHash)
+
+		digest := h.New()
+		digest.Write([]byte(text))
+		require.Equal(digest.Sum(nil), sig2.BasisDigest)
+
+		_, err = SignatureOptions{BlockSize: blockSize, StrongSize: byte(h.Size() + 1), StrongHash: h}.WriteSignature(bytes.NewBufferString(text), rw)
+		require.Error(err)
+	}
+
+	_, err := SignatureOptions{BlockSize: blockSize, StrongSize: 4, StrongHash: StrongHash(0xff)}.WriteSignature(bytes.NewBufferString(text), bytes.NewBuffer(nil))
+	require.Error(err)
+}
+
+func TestSignatureOptions(t *testing.T) {
+	require := require.New(t)
+
+	const text = `ala ma kota,kot ma ale`
+
+	sig1Buffer := bytes.NewBuffer(nil)
+	sig1, err := SignatureOptions{BlockSize: 4, StrongSize: 8, WeakHash: RabinKarp, StrongHash: SHA256}.WriteSignature(bytes.NewBufferString(text), sig1Buffer)
+	require.NoError(err)
+
+	opts := SignatureOptions{BlockSize: 4, StrongSize: 8, WeakHash: RabinKarp, StrongHash: SHA256}
+	for _, bufferSize := range []int{0, 1, 3, 1024} {
+		opts.BufferSize = bufferSize
+		sig2Buffer := bytes.NewBuffer(nil)
+		sig2, err := opts.WriteSignature(bytes.NewBufferString(text), sig2Buffer)
+		require.NoError(err)
+		require.EqualValues(sig1, sig2)
+		require.Equal(sig1Buffer.Bytes(), sig2Buffer.Bytes())
+	}
+
+	opts = SignatureOptions{Format: Rdiff, BlockSize: 4, StrongSize: 8, StrongHash: BLAKE2b}
+	sig, err := opts.WriteSignature(bytes.NewBufferString(text), bytes.NewBuffer(nil))
+	require.NoError(err)
+	require.Equal(Rdiff, sig.Format)
+
+	opts.StrongHash = MD5
+	_, err = opts.WriteSignature(bytes.NewBufferString(text), bytes.NewBuffer(nil))
+	require.Error(err)
+
+	opts = SignatureOptions{Format: Format(0xff), BlockSize: 4, StrongSize: 8}
+	_, err = opts.WriteSignature(bytes.NewBufferString(text), bytes.NewBuffer(nil))
+	require.Error(err)
+
+	// the zero value recommends sizes
+	sig, err = SignatureOptions{}.WriteSignature(bytes.NewBufferString(text), bytes.NewBuffer(nil))
+	require.NoError(err)
+	require.Equal(minBlockSize, sig.BlockSize)
+}
+
+// shortReaders returns readers of b, which return fewer bytes than asked for (or data with io.EOF).
+func shortReaders(b []byte) map[string]io.Reader {
+	return map[string]io.Reader{
+		"one byte": iotest.OneByteReader(bytes.NewReader(b)),
+		"half":     iotest.HalfReader(bytes.NewReader(b)),
+		"data err": iotest.DataErrReader(bytes.NewReader(b)),
+		"random":   &randomReader{r: bytes.NewReader(b), rnd: rand.New(rand.NewSource(int64(len(b))))},
+	}
+}
+
+// randomReader reads up to a random number of bytes at a time.
+type randomReader struct {
+	r   io.Reader
+	rnd *rand.Rand
+}
+
+func (r *randomReader) Read(p []byte) (int, error) {
+	if len(p) > 1 {
+		p = p[:1+r.rnd.Intn(len(p))]
+	}
+	return r.r.Read(p)
+}
+
+func TestSignatureShortReads(t *testing.T) {
+	require := require.New(t)
+
+	basis := bytes.Repeat([]byte(`ala ma kota,kot ma ale,`), 50)
+	for _, opts := range []SignatureOptions{
+		{BlockSize: 16, StrongSize: 8},
+		{Format: Rdiff, BlockSize: 16, StrongSize: 8, StrongHash: MD4},
+	} {
+		buf := bytes.NewBuffer(nil)
+		_, err := opts.WriteSignature(bytes.NewReader(basis), buf)
+		require.NoError(err)
+		b := buf.Bytes()
+
+		expected, err := ReadSignature(bytes.NewReader(b))
+		require.NoError(err)
+		for name, r := range shortReaders(b) {
+			sig, err := ReadSignature(r)
+			require.NoError(err, name)
+			require.Equal(expected, sig, name)
+		}
+
+		// truncated records
+		for n := 1; n < len(b); n++ {
+			_, err = ReadSignature(iotest.OneByteReader(bytes.NewReader(b[:n])))
+			if opts.Format == Rdiff && n >= 12 && (n-12)%(4+int(opts.StrongSize)) == 0 {
+				// librsync signatures do not record the number of blocks
+				require.NoError(err, "truncated at %d", n)
+				continue
+			}
+			require.ErrorIs(err, io.ErrUnexpectedEOF, "truncated at %d", n)
+		}
+	}
+}
+
+func TestOpenSignature(t *testing.T) {
+	require := require.New(t)
+
+	basis := make([]byte, 10000)
+	rand.New(rand.NewSource(1)).Read(basis)
+	// repeated blocks share their weak checksums
+	copy(basis[4000:], basis[:2000])
+	newData := append(append([]byte(`toj es tto,`), basis[:7000]...), basis[7500:]...)
+
+	for _, opts := range []SignatureOptions{
+		{BlockSize: 64, StrongSize: 8},
+		{Format: Rdiff, BlockSize: 100, StrongSize: 8, StrongHash: MD4},
+	} {
+		buf := bytes.NewBuffer(nil)
+		sig, err := opts.WriteSignature(bytes.NewReader(basis), buf)
+		require.NoError(err)
+		b := buf.Bytes()
+
+		opened, err := OpenSignature(bytes.NewReader(b))
+		require.NoError(err)
+		require.Equal(sig.signatureHeader, opened.signatureHeader)
+		require.Equal(sig.index, opened.index)
+		require.Empty(opened.strong)
+
+		for i := range sig.index {
+			weak := sig.index.weak(i)
+			blocks, err := sig.LookupAll(weak)
+			require.NoError(err)
+			openedBlocks, err := opened.LookupAll(weak)
+			require.NoError(err)
+			require.Equal(blocks, openedBlocks)
+			strong, offset, size, ok := opened.Lookup(weak)
+			require.True(ok)
+			require.Equal(blocks[0], Block{Weak: weak, Strong: strong, Offset: offset, Size: size})
+		}
+
+		// strong checksums which cannot be read are errors, not missing blocks
+		r := &failingReaderAt{ReaderAt: bytes.NewReader(b)}
+		failing, err := OpenSignature(r)
+		require.NoError(err)
+		r.err = errors.New("read error")
+		_, err = failing.LookupAll(sig.index.weak(0))
+		require.ErrorIs(err, r.err)
+		_, _, _, ok := failing.Lookup(sig.index.weak(0))
+		require.False(ok)
+
+		expected := bytes.NewBuffer(nil)
+		require.NoError(WriteDelta(sig, bytes.NewReader(newData), expected))
+		delta := bytes.NewBuffer(nil)
+		require.NoError(WriteDelta(opened, bytes.NewReader(newData), delta))
+		require.Equal(expected.Bytes(), delta.Bytes())
+
+		// the signature shrinks after it was opened
+		opened, err = OpenSignature(bytes.NewReader(b))
+		require.NoError(err)
+		opened.strongReader = bytes.NewReader(b[:len(b)/2])
+		err = WriteDelta(opened, bytes.NewReader(newData), io.Discard)
+		require.ErrorIs(err, ErrInvalidSignature)
+		require.ErrorIs(err, io.ErrUnexpectedEOF)
+
+		for n := 5; n < len(b); n += 7 {
+			if _, err := ReadSignature(bytes.NewReader(b[:n])); err != nil {
+				_, err = OpenSignature(bytes.NewReader(b[:n]))
+				require.ErrorIs(err, ErrInvalidSignature, "truncated at %d", n)
+			}
+		}
+	}
+}
+
+func TestSignatureBlocks(t *testing.T) {
+	require := require.New(t)
+
+	const text = `baababbabaabxxxx1234xxxxyy`
+	for _, opts := range []SignatureOptions{
+		{BlockSize: 4, StrongSize: 4},
+		{Format: Rdiff, BlockSize: 4, StrongSize: 4, StrongHash: MD4},
+	} {
+		buf := bytes.NewBuffer(nil)
+		sig, err := opts.WriteSignature(bytes.NewBufferString(text), buf)
+		require.NoError(err)
+		opened, err := OpenSignature(bytes.NewReader(buf.Bytes()))
+		require.NoError(err)
+
+		for _, sig := range []*Signature{sig, opened} {
+			require.Equal(7, sig.BlockCount())
+			length, exact := sig.Length()
+			require.Equal(opts.Format == Native, exact)
+			if exact {
+				require.EqualValues(len(text), length)
+			} else {
+				require.EqualValues(7*4, length)
+			}
+
+			var blocks []Block
+			require.NoError(sig.Blocks(func(n int, b Block) bool {
+				require.Len(blocks, n)
+				blocks = append(blocks, b)
+				return true
+			}))
+			require.Len(blocks, 7)
+			for n, b := range blocks {
+				end := min(4*(n+1), len(text))
+				if !exact {
+					end = 4 * (n + 1)
+				}
+				require.EqualValues(4*n, b.Offset)
+				require.EqualValues(end-4*n, b.Size)
+				require.Equal(opts.WeakHash.checksum([]byte(text[4*n:min(end, len(text))])), b.Weak)
+				blocks, err := sig.LookupAll(b.Weak)
+				require.NoError(err)
+				require.Contains(blocks, b)
+			}
+
+			// fn stops the iteration
+			count := 0
+			require.NoError(sig.Blocks(func(n int, b Block) bool {
+				count++
+				return n < 2
+			}))
+			require.Equal(3, count)
+		}
+	}
+}
+
+// failingReaderAt returns err, once it is set.
+type failingReaderAt struct {
+	io.ReaderAt
+	err error
+}
+
+func (r *failingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	return r.ReaderAt.ReadAt(p, off)
+}
+
+// hookReader calls hook before every read.
+type hookReader struct {
+	io.Reader
+	hook func()
+}
+
+func (r *hookReader) Read(p []byte) (int, error) {
+	r.hook()
+	return r.Reader.Read(p)
+}
@@ -0,0 +1,210 @@
+package diff
+
+import (
+	"io"
+	"math"
+	"slices"
+)
+
+// maxLargestLiterals is the number of literal runs DeltaStats keeps.
+const maxLargestLiterals = 10
+
+type (
+	// DeltaStats describes a delta, e.g. to find out why it is as large as it is.
+	DeltaStats struct {
+		Header DeltaHeader
+		// Size is the number of bytes read from the delta, Length the length of the new file.
+		Size   int64
+		Length uint64
+		// Copies and Literals are the numbers of instructions, CopyBytes and LiteralBytes the bytes they recreate.
+		Copies       int
+		Literals     int
+		CopyBytes    uint64
+		LiteralBytes uint64
+		// LargestLiterals are the longest runs of literal data (of adjacent literal instructions) in the new file, longest first.
+		LargestLiterals []DeltaRange
+		// Coverage holds the basis ranges which are copied (sorted and merged), BasisBytes is the number of bytes they cover.
+		Coverage   []DeltaRange
+		BasisBytes uint64
+	}
+
+	// DeltaRange is a range of bytes, in the new file or in the basis.
+	DeltaRange struct {
+		Offset uint64
+		Size   uint64
+	}
+
+	// countingReader counts the bytes read from the underlying reader.
+	countingReader struct {
+		io.Reader
+		n int64
+	}
+)
+
+// SignatureStats describes the blocks of a signature, to tune block and strong checksum sizes.
+type SignatureStats struct {
+	// Blocks is the number of blocks, Length the basis length (see Signature.Length).
+	Blocks int
+	Length uint64
+	// WeakChecksums is the number of distinct weak checksums.
+	WeakChecksums int
+	// WeakCollisions is the number of distinct blocks sharing a weak checksum, beyond the first block of each weak checksum
+	// (duplicate blocks count once). Windows with a colliding weak checksum are compared with the strong checksum of each block.
+	WeakCollisions int
+	// DuplicateBlocks is the number of blocks with the same checksums as a block before them (e.g. zero-filled blocks).
+	DuplicateBlocks int
+	// MaxWeakBlocks is the largest number of blocks sharing a weak checksum.
+	MaxWeakBlocks int
+	// FalseMatchProbability estimates the probability that a new file of up to Length+16MB bytes matches a block
+	// it does not contain: every window is assumed to be compared with the strong checksum of every distinct block,
+	// as RecommendBlockSize does.
+	FalseMatchProbability float64
+}
+
+// Stats returns the statistics of the signature.
+// Strong checksums of signatures opened with OpenSignature are read for blocks sharing their weak checksum.
+func (sig *Signature) Stats() (SignatureStats, error) {
+	stats := SignatureStats{Blocks: sig.count()}
+	stats.Length, _ = sig.Length()
+
+	// blocks sharing a weak checksum are adjacent in the index
+	strongs := make(map[string]struct{})
+	for i := 0; i < len(sig.index); {
+		idx := sig.index.lookup(sig.index.weak(i))
+		i += len(idx)
+		stats.WeakChecksums++
+		stats.MaxWeakBlocks = max(stats.MaxWeakBlocks, len(idx))
+		if len(idx) == 1 {
+			continue
+		}
+
+		clear(strongs)
+		for k := range idx {
+			strong, err := sig.strongChecksum(idx.block(k), nil)
+			if err != nil {
+				return SignatureStats{}, err
+			}
+			strongs[string(strong)] = struct{}{}
+		}
+		stats.WeakCollisions += len(strongs) - 1
+		stats.DuplicateBlocks += len(idx) - len(strongs)
+	}
+
+	distinct := float64(stats.Blocks - stats.DuplicateBlocks)
+	windows := float64(stats.Length) + 1<<24
+	// the probability of at least one false match, out of windows*distinct strong checksum comparisons
+	stats.FalseMatchProbability = -math.Expm1(-windows * distinct * math.Exp2(-8*float64(sig.StrongSize)))
+	return stats, nil
+}
+
+// ReadDeltaStats reads the whole delta from deltaReader, and returns its statistics.
+// fn, unless nil, is called with every instruction and its offset in the delta (see CorruptDeltaError),
+// and stops reading by returning an error.
+func ReadDeltaStats(deltaReader io.Reader, fn func(offset int64, i DeltaInstructionHeader) error) (*DeltaStats, error) {
+	r := &countingReader{Reader: deltaReader}
+	dr, err := newDeltaReader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &DeltaStats{Header: dr.header}
+	var copies []DeltaRange
+	literal := DeltaRange{}
+	for {
+		i, err := dr.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if fn != nil {
+			if err = fn(dr.start, i); err != nil {
+				return nil, err
+			}
+		}
+
+		switch i.From {
+		case FromOld:
+			stats.Copies++
+			stats.CopyBytes += i.Size
+			copies = append(copies, DeltaRange{Offset: i.Offset, Size: i.Size})
+			stats.addLiteral(literal)
+			literal = DeltaRange{}
+		case FromNew:
+			stats.Literals++
+			stats.LiteralBytes += i.Size
+			if literal.Size == 0 {
+				literal.Offset = stats.Length
+			}
+			literal.Size += i.Size
+			if err = dr.copyData(io.Discard, i.Size, nil); err != nil {
+				return nil, err
+			}
+		}
+		stats.Length += i.Size
+	}
+	stats.addLiteral(literal)
+	stats.Size = r.n
+	stats.Coverage, stats.BasisBytes = mergeRanges(copies)
+	return stats, nil
+}
+
+// CompressionRatio returns the length of the new file divided by the size of the delta.
+func (stats *DeltaStats) CompressionRatio() float64 {
+	if stats.Size == 0 {
+		return 0
+	}
+	return float64(stats.Length) / float64(stats.Size)
+}
+
+// addLiteral keeps the literal run, if it is one of the longest.
+func (stats *DeltaStats) addLiteral(literal DeltaRange) {
+	if literal.Size == 0 {
+		return
+	}
+	n := len(stats.LargestLiterals)
+	for n > 0 && stats.LargestLiterals[n-1].Size < literal.Size {
+		n--
+	}
+	if n < maxLargestLiterals {
+		stats.LargestLiterals = slices.Insert(stats.LargestLiterals, n, literal)
+		stats.LargestLiterals = stats.LargestLiterals[:min(len(stats.LargestLiterals), maxLargestLiterals)]
+	}
+}
+
+// mergeRanges sorts the ranges and merges those which overlap or touch, and returns them with the number of bytes they cover.
+func mergeRanges(ranges []DeltaRange) ([]DeltaRange, uint64) {
+	slices.SortFunc(ranges, func(a, b DeltaRange) int {
+		switch {
+		case a.Offset < b.Offset:
+			return -1
+		case a.Offset > b.Offset:
+			return 1
+		}
+		return 0
+	})
+
+	merged := ranges[:0]
+	size := uint64(0)
+	for _, r := range ranges {
+		if r.Size == 0 {
+			continue
+		}
+		if n := len(merged) - 1; n >= 0 && r.Offset <= merged[n].Offset+merged[n].Size {
+			end := max(merged[n].Offset+merged[n].Size, r.Offset+r.Size)
+			size += end - (merged[n].Offset + merged[n].Size)
+			merged[n].Size = end - merged[n].Offset
+			continue
+		}
+		merged = append(merged, r)
+		size += r.Size
+	}
+	return merged, size
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n += int64(n)
+	return n, err
+}
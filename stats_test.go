@@ -0,0 +1,145 @@
+package diff
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignatureStats(t *testing.T) {
+	require := require.New(t)
+
+	// "baab" and "abba" share the weak checksum, "baab" and "xxxx" are repeated, "yy" is the final block
+	const text = `baababbabaabxxxx1234xxxxyy`
+	for _, opts := range []SignatureOptions{
+		{BlockSize: 4, StrongSize: 4},
+		{Format: Rdiff, BlockSize: 4, StrongSize: 4, StrongHash: MD4},
+	} {
+		buf := bytes.NewBuffer(nil)
+		sig, err := opts.WriteSignature(bytes.NewBufferString(text), buf)
+		require.NoError(err)
+		opened, err := OpenSignature(bytes.NewReader(buf.Bytes()))
+		require.NoError(err)
+
+		for _, sig := range []*Signature{sig, opened} {
+			stats, err := sig.Stats()
+			require.NoError(err)
+			require.Equal(7, stats.Blocks)
+			require.Equal(4, stats.WeakChecksums)
+			require.Equal(1, stats.WeakCollisions)
+			require.Equal(2, stats.DuplicateBlocks)
+			require.Equal(3, stats.MaxWeakBlocks)
+			if opts.Format == Native {
+				require.EqualValues(len(text), stats.Length)
+			} else {
+				require.EqualValues(7*4, stats.Length)
+			}
+			require.Greater(stats.FalseMatchProbability, 0.0)
+			require.Less(stats.FalseMatchProbability, 1.0)
+		}
+	}
+
+	// longer strong checksums make false matches less likely
+	basis := bytes.Repeat([]byte(`ala ma kota,kot ma ale,`), 1000)
+	p := 1.0
+	for _, strongSize := range []byte{4, 8, 16} {
+		sig, err := SignatureOptions{BlockSize: 64, StrongSize: strongSize}.WriteSignature(bytes.NewReader(basis), io.Discard)
+		require.NoError(err)
+		stats, err := sig.Stats()
+		require.NoError(err)
+		require.Less(stats.FalseMatchProbability, p)
+		p = stats.FalseMatchProbability
+	}
+}
+
+func TestDeltaStats(t *testing.T) {
+	require := require.New(t)
+
+	basis := bytes.Repeat([]byte(`ala ma kota,kot ma ale,`), 100)
+	for i := range basis {
+		// no repeated blocks
+		basis[i] += byte(i / 23)
+	}
+	newData := append([]byte(`toj es tto,`), basis[:640]...)
+	newData = append(newData, bytes.Repeat([]byte(`x`), 100)...)
+	newData = append(newData, basis[320:960]...)
+	newData = append(newData, `lal al ala`...)
+
+	for _, opts := range []DeltaOptions{
+		{},
+		{Encoding: CompactEncoding, Compression: FlateCompression},
+		{Format: Rdiff},
+	} {
+		sig, err := SignatureOptions{Format: opts.Format, BlockSize: 32, StrongSize: 8, StrongHash: MD4}.WriteSignature(bytes.NewReader(basis), io.Discard)
+		require.NoError(err)
+		buf := bytes.NewBuffer(nil)
+		require.NoError(opts.WriteDelta(sig, bytes.NewReader(newData), buf))
+		delta, err := ReadDelta(bytes.NewReader(buf.Bytes()))
+		require.NoError(err)
+		header, err := ReadDeltaHeader(bytes.NewReader(buf.Bytes()))
+		require.NoError(err)
+
+		var instructions []DeltaInstructionHeader
+		var offsets []int64
+		stats, err := ReadDeltaStats(bytes.NewReader(buf.Bytes()), func(offset int64, i DeltaInstructionHeader) error {
+			offsets = append(offsets, offset)
+			instructions = append(instructions, i)
+			return nil
+		})
+		require.NoError(err)
+		require.Len(instructions, len(delta))
+		for n, i := range delta {
+			require.Equal(i.DeltaInstructionHeader, instructions[n])
+		}
+		require.IsIncreasing(offsets)
+
+		require.Equal(header, stats.Header)
+		require.EqualValues(buf.Len(), stats.Size)
+		require.EqualValues(len(newData), stats.Length)
+		require.Equal(stats.Length, stats.CopyBytes+stats.LiteralBytes)
+		require.Equal(len(delta), stats.Copies+stats.Literals)
+		require.EqualValues(11+100+10, stats.LiteralBytes)
+		require.Equal([]DeltaRange{{Offset: 11 + 640, Size: 100}, {Offset: 0, Size: 11}, {Offset: uint64(len(newData)) - 10, Size: 10}}, stats.LargestLiterals)
+		require.Equal([]DeltaRange{{Offset: 0, Size: 960}}, stats.Coverage)
+		require.EqualValues(960, stats.BasisBytes)
+		require.InDelta(float64(len(newData))/float64(buf.Len()), stats.CompressionRatio(), 1e-9)
+
+		// fn stops reading
+		stop := io.ErrClosedPipe
+		_, err = ReadDeltaStats(bytes.NewReader(buf.Bytes()), func(int64, DeltaInstructionHeader) error { return stop })
+		require.Equal(stop, err)
+		// truncated deltas
+		_, err = ReadDeltaStats(bytes.NewReader(buf.Bytes()[:buf.Len()-1]), nil)
+		require.ErrorIs(err, ErrCorruptDelta)
+	}
+}
+
+func TestDeltaStatsLargestLiterals(t *testing.T) {
+	require := require.New(t)
+
+	stats := &DeltaStats{}
+	for size := uint64(1); size <= 2*maxLargestLiterals; size++ {
+		stats.addLiteral(DeltaRange{Offset: size * 100, Size: size % 7})
+	}
+	require.Len(stats.LargestLiterals, maxLargestLiterals)
+	for n := 1; n < len(stats.LargestLiterals); n++ {
+		require.GreaterOrEqual(stats.LargestLiterals[n-1].Size, stats.LargestLiterals[n].Size)
+	}
+	require.EqualValues(6, stats.LargestLiterals[0].Size)
+	// the first of equally long runs comes first
+	require.EqualValues(600, stats.LargestLiterals[0].Offset)
+}
+
+func TestMergeRanges(t *testing.T) {
+	require := require.New(t)
+
+	merged, size := mergeRanges([]DeltaRange{{10, 5}, {0, 4}, {4, 2}, {12, 10}, {30, 0}, {40, 1}, {0, 1}})
+	require.Equal([]DeltaRange{{0, 6}, {10, 12}, {40, 1}}, merged)
+	require.EqualValues(6+12+1, size)
+
+	merged, size = mergeRanges(nil)
+	require.Empty(merged)
+	require.Zero(size)
+}